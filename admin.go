@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// orphanGrace keeps cleanup away from files younger than this, so an upload
+// that has written its file but not yet inserted its row is left alone.
+const orphanGrace = 10 * time.Minute
+
+// adminToken guards the /admin endpoints; they are disabled when empty.
+var adminToken = os.Getenv("GALLERY_ADMIN_TOKEN")
+
+// adminAuth requires "Authorization: Bearer <GALLERY_ADMIN_TOKEN>".
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			writeJSONError(w, http.StatusForbidden, "admin endpoints are disabled")
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(adminToken)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func cleanupHandler(w http.ResponseWriter, r *http.Request) {
+	images, thumbs, err := cleanupOrphans()
+	if err != nil {
+		log.Println("cleanup error:", err)
+		writeJSONError(w, http.StatusInternalServerError, "cleanup failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{
+		"images_removed": images,
+		"thumbs_removed": thumbs,
+	})
+}
+
+// cleanupOrphans removes originals that have no row in the images table and
+// thumbnails whose source image is gone. Files touched within orphanGrace
+// are skipped so it is safe to run while uploads are in flight. It scans
+// the local imagesDir and thumbsDir, so it only applies to LocalStorage.
+func cleanupOrphans() (imagesRemoved, thumbsRemoved int, err error) {
+	known, err := knownFilenames()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	entries, err := os.ReadDir(imagesDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || known[e.Name()] || recentlyModified(e) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(imagesDir, e.Name())); err != nil {
+			log.Println("cleanup remove image error:", err)
+			continue
+		}
+		log.Printf("cleanup: removed orphaned image %s", e.Name())
+		imagesRemoved++
+	}
+
+	entries, err = os.ReadDir(thumbsDir)
+	if err != nil {
+		return imagesRemoved, 0, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || recentlyModified(e) {
+			continue
+		}
+		if src := thumbSource(e.Name(), known); src != "" {
+			if _, err := os.Stat(filepath.Join(imagesDir, src)); err == nil {
+				continue
+			}
+		}
+		if err := os.Remove(filepath.Join(thumbsDir, e.Name())); err != nil {
+			log.Println("cleanup remove thumb error:", err)
+			continue
+		}
+		log.Printf("cleanup: removed orphaned thumbnail %s", e.Name())
+		thumbsRemoved++
+	}
+	return imagesRemoved, thumbsRemoved, nil
+}
+
+// knownFilenames returns the set of original filenames referenced by rows.
+func knownFilenames() (map[string]bool, error) {
+	rows, err := db.Query("SELECT filename FROM images")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	known := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		known[filepath.Base(name)] = true
+	}
+	return known, rows.Err()
+}
+
+func recentlyModified(e os.DirEntry) bool {
+	info, err := e.Info()
+	return err != nil || time.Since(info.ModTime()) < orphanGrace
+}
+
+// regenerateWorkers bounds how many images /admin/thumbs/regenerate
+// processes at once, leaving cores free for regular traffic.
+func regenerateWorkers() int {
+	return max(1, runtime.NumCPU()/2)
+}
+
+// regenJob is the progress of the running or last thumbnail
+// regeneration, as reported by GET /admin/thumbs/regenerate.
+type regenJob struct {
+	Running     bool       `json:"running"`
+	Size        string     `json:"size,omitempty"`
+	Images      int        `json:"images"`
+	Done        int        `json:"done"`
+	Deleted     int        `json:"deleted"`
+	Regenerated int        `json:"regenerated"`
+	Failed      int        `json:"failed"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+var (
+	regenMu  sync.Mutex
+	regenCur regenJob
+)
+
+// regenerateStatusHandler reports the running or last regeneration.
+func regenerateStatusHandler(w http.ResponseWriter, r *http.Request) {
+	regenMu.Lock()
+	job := regenCur
+	regenMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// regenerateThumbsHandler drops cached thumbnails, all sizes or only
+// ?size=WxH, and unless ?regenerate=false builds them again for every
+// image: the given size, or the usual pre-generated sizes. Large galleries
+// take longer than any request deadline, so the work runs in the
+// background; it answers 202 with the job, or 409 while one is running.
+func regenerateThumbsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	size := q.Get("size")
+	if size != "" && !allowedThumbSize(size) {
+		writeJSONError(w, http.StatusBadRequest, "size not allowed")
+		return
+	}
+	regenerate := q.Get("regenerate") != "false" && q.Get("regenerate") != "0"
+
+	known, err := knownFilenames()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	regenMu.Lock()
+	if regenCur.Running {
+		regenMu.Unlock()
+		writeJSONError(w, http.StatusConflict, "a regeneration is already running")
+		return
+	}
+	now := time.Now()
+	regenCur = regenJob{Running: true, Size: size, Images: len(known), StartedAt: &now}
+	job := regenCur
+	regenMu.Unlock()
+
+	go regenerateThumbs(known, size, regenerate)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// regenerateThumbs does the work of regenerateThumbsHandler, recording
+// progress in regenCur.
+func regenerateThumbs(known map[string]bool, size string, regenerate bool) {
+	sizes := pregenThumbSizes
+	if size != "" {
+		sizes = []string{size}
+	}
+	record := func(update func(*regenJob)) {
+		regenMu.Lock()
+		update(&regenCur)
+		regenMu.Unlock()
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < regenerateWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range jobs {
+				// the names come from thumbName, so size-capped
+				// thumbnails of small originals are matched too
+				names := thumbVariants(filename)
+				if size != "" {
+					names = thumbSizeVariants(filename, []string{size})
+				}
+				deleted := 0
+				for _, name := range names {
+					if err := thumbStore.Delete(name); err == nil {
+						deleted++
+					} else if !os.IsNotExist(err) {
+						log.Println("remove thumb error:", err)
+					}
+				}
+				regenerated, failed := 0, 0
+				if regenerate {
+					for _, s := range sizes {
+						tw, th, _ := parseThumbSize(s)
+						if _, err := generateThumb(context.Background(), filename, thumbSpec{W: tw, H: th, Mode: modeFit}); err != nil {
+							log.Printf("regenerate %s %s: %v", s, filename, err)
+							failed++
+							continue
+						}
+						regenerated++
+					}
+				}
+				var done int
+				record(func(j *regenJob) {
+					j.Deleted += deleted
+					j.Regenerated += regenerated
+					j.Failed += failed
+					j.Done++
+					done = j.Done
+				})
+				if done%100 == 0 {
+					log.Printf("thumbnail regeneration: %d of %d images", done, len(known))
+				}
+			}
+		}()
+	}
+	for filename := range known {
+		jobs <- filename
+	}
+	close(jobs)
+	wg.Wait()
+
+	var job regenJob
+	record(func(j *regenJob) {
+		now := time.Now()
+		j.Running = false
+		j.FinishedAt = &now
+		job = *j
+	})
+	log.Printf("thumbnail regeneration done: %d images, %d deleted, %d regenerated, %d failed",
+		job.Images, job.Deleted, job.Regenerated, job.Failed)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// albumKey maps an album name from a URL to the stored value, where
+// uncategorized images have an empty album.
+func albumKey(name string) string {
+	if name == uncategorizedLabel {
+		return ""
+	}
+	return normalizeAlbum(name)
+}
+
+// normalizeAlbum cleans an album name before it is stored or matched:
+// surrounding and repeated whitespace goes, control characters are dropped
+// and slashes become dashes so names stay safe in paths. With
+// lowercaseAlbums set, names are also folded to lower case.
+func normalizeAlbum(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '-'
+		case unicode.IsSpace(r):
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.Join(strings.Fields(s), " ")
+	if lowercaseAlbums {
+		s = strings.ToLower(s)
+	}
+	return s
+}
+
+// normalizeAlbums normalizes a list of album names, dropping empty names
+// and duplicates.
+func normalizeAlbums(in []string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, a := range in {
+		a = normalizeAlbum(a)
+		if a == "" || seen[a] {
+			continue
+		}
+		seen[a] = true
+		out = append(out, a)
+	}
+	return out
+}
+
+// albumCond is the condition matching images filed under album key, as
+// their primary album or an additional one. It takes key as its argument.
+// Uncategorized images have no image_albums rows, so "" checks the column.
+func albumCond(key string) string {
+	if key == "" {
+		return "COALESCE(album, '') = ?"
+	}
+	return "id IN (SELECT image_id FROM image_albums WHERE album = ?)"
+}
+
+// positionIn returns the manual position of an image within album key as
+// an SQL expression over images, with its placeholder arguments.
+// Uncategorized images have no memberships, so their order is kept in
+// images.position.
+func positionIn(key string) (string, []interface{}) {
+	if key == "" {
+		return "COALESCE(position, 0)", nil
+	}
+	return "COALESCE((SELECT position FROM image_albums WHERE image_id = images.id AND album = ?), 0)", []interface{}{key}
+}
+
+// inAlbum reports whether img is filed under album key.
+func inAlbum(img ImageRow, key string) bool {
+	if key == "" {
+		return img.Album == ""
+	}
+	return slices.Contains(img.Albums, key)
+}
+
+// albumMembers selects (album, image_id) for every live image in every
+// album it is filed under, with uncategorized images under "".
+const albumMembers = `SELECT ia.album AS album, i.id AS image_id FROM image_albums ia JOIN images i ON i.id = ia.image_id WHERE i.deleted_at IS NULL
+	UNION ALL SELECT '', id FROM images WHERE deleted_at IS NULL AND COALESCE(album, '') = ''`
+
+// setImageAlbums files image id under exactly albums. The primary album
+// is kept when listed and otherwise becomes the first one; an empty list
+// leaves the image uncategorized.
+func setImageAlbums(id string, albums []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var primary string
+	if err := tx.QueryRow("SELECT COALESCE(album, '') FROM images WHERE id = ?", id).Scan(&primary); err != nil {
+		return err
+	}
+	listed := false
+	for _, a := range albums {
+		listed = listed || a == primary
+	}
+	if !listed {
+		primary = ""
+		if len(albums) > 0 {
+			primary = albums[0]
+		}
+		// the triggers move the primary membership along
+		if _, err := tx.Exec("UPDATE images SET album = ? WHERE id = ?", primary, id); err != nil {
+			return err
+		}
+	}
+
+	args := []interface{}{id}
+	for _, a := range albums {
+		args = append(args, a)
+	}
+	if _, err := tx.Exec("DELETE FROM image_albums WHERE image_id = ? AND album NOT IN ("+placeholders(len(albums))+")", args...); err != nil {
+		return err
+	}
+	for _, a := range albums {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO image_albums(image_id, album) VALUES(?, ?)", id, a); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// albumCover resolves the cover of an album: the explicitly chosen image if
+// it is still live and in the album, otherwise the most recent image.
+func albumCover(key string) (id, filename string, err error) {
+	err = db.QueryRow(`SELECT id, filename FROM images
+		WHERE deleted_at IS NULL AND `+albumCond(key)+`
+		ORDER BY id = COALESCE((SELECT cover_image_id FROM albums WHERE name = ?), '') DESC, created_at DESC, id DESC
+		LIMIT 1`, key, key).Scan(&id, &filename)
+	return id, filename, err
+}
+
+// setAlbumCoverHandler picks the cover image of an album from {"id": "..."}.
+func setAlbumCoverHandler(w http.ResponseWriter, r *http.Request) {
+	album := mux.Vars(r)["album"]
+	key := albumKey(album)
+	var body struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ID == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	img, err := getImage(body.ID)
+	if err == sql.ErrNoRows || (err == nil && img.DeletedAt != nil) {
+		writeJSONError(w, http.StatusNotFound, "image not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if !inAlbum(img, key) {
+		writeJSONError(w, http.StatusBadRequest, "image is not in this album")
+		return
+	}
+
+	_, err = db.Exec(`INSERT INTO albums(name, cover_image_id) VALUES(?, ?)
+		ON CONFLICT(name) DO UPDATE SET cover_image_id = excluded.cover_image_id`, key, img.ID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"album":          album,
+		"cover_id":       img.ID,
+		"cover_filename": img.Filename,
+	})
+}
+
+// reorderAlbumHandler stores a manual order for an album. The listed ids
+// get positions 1..n; images left out keep their relative order after them.
+// Each album has its own order, extra members included.
+func reorderAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	key := albumKey(mux.Vars(r)["album"])
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if len(body.IDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "ids must not be empty")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	defer tx.Rollback()
+
+	position, posArgs := positionIn(key)
+	rows, err := tx.Query("SELECT id FROM images WHERE "+albumCond(key)+" AND deleted_at IS NULL ORDER BY "+position+", created_at, id",
+		append([]interface{}{key}, posArgs...)...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	inAlbum := map[string]bool{}
+	var current []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			writeJSONError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		inAlbum[id] = true
+		current = append(current, id)
+	}
+	rows.Close()
+
+	order := make([]string, 0, len(current))
+	listed := map[string]bool{}
+	for _, id := range body.IDs {
+		if !inAlbum[id] {
+			writeJSONError(w, http.StatusBadRequest, "image "+id+" is not in this album")
+			return
+		}
+		if listed[id] {
+			writeJSONError(w, http.StatusBadRequest, "duplicate id "+id)
+			return
+		}
+		listed[id] = true
+		order = append(order, id)
+	}
+	for _, id := range current {
+		if !listed[id] {
+			order = append(order, id)
+		}
+	}
+
+	now := time.Now().Unix()
+	for i, id := range order {
+		_, err := tx.Exec("UPDATE images SET updated_at = ? WHERE id = ?", now, id)
+		if err == nil && key == "" {
+			_, err = tx.Exec("UPDATE images SET position = ? WHERE id = ?", i+1, id)
+		} else if err == nil {
+			_, err = tx.Exec("UPDATE image_albums SET position = ? WHERE image_id = ? AND album = ?", i+1, id, key)
+		}
+		if err != nil {
+			log.Println("reorder error:", err)
+			writeJSONError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"album": key, "ids": order})
+}
+
+// renameAlbumHandler moves every image of album "from" to album "to" from
+// {"from": "...", "to": "..."}. Renaming onto an existing album merges the
+// two. It reports how many images moved.
+func renameAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	from, to := normalizeAlbum(body.From), normalizeAlbum(body.To)
+	if from == "" || to == "" {
+		writeJSONError(w, http.StatusBadRequest, "from and to must not be empty")
+		return
+	}
+	if from == to {
+		writeJSONError(w, http.StatusBadRequest, "from and to are the same album")
+		return
+	}
+
+	n, err := renameAlbum(from, to)
+	if err != nil {
+		log.Println("rename album error:", err)
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if n == 0 {
+		writeJSONError(w, http.StatusNotFound, "album not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"from": from, "to": to, "moved": n})
+}
+
+// renameAlbum moves the images of album from, trashed ones included, to
+// album to in one transaction and returns how many there were. Moved
+// images keep their manual order after those already in to, and the
+// album's cover choice goes along unless to has one.
+func renameAlbum(from, to string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var n, offset int
+	if err := tx.QueryRow("SELECT COUNT(1) FROM image_albums WHERE album = ?", from).Scan(&n); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := tx.QueryRow("SELECT COALESCE(MAX(position), 0) FROM image_albums WHERE album = ?", to).Scan(&offset); err != nil {
+		return 0, err
+	}
+
+	// memberships move first, keeping their order; images already in to
+	// keep their place there. The primary album follows, and the triggers
+	// find its membership already moved.
+	stmts := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"UPDATE OR IGNORE image_albums SET album = ?, position = COALESCE(position, 0) + ? WHERE album = ?", []interface{}{to, offset, from}},
+		{"DELETE FROM image_albums WHERE album = ?", []interface{}{from}},
+		{"UPDATE images SET album = ?, updated_at = ? WHERE album = ?", []interface{}{to, time.Now().Unix(), from}},
+		{"UPDATE OR IGNORE albums SET name = ? WHERE name = ?", []interface{}{to, from}},
+		{"DELETE FROM albums WHERE name = ?", []interface{}{from}},
+	}
+	for _, s := range stmts {
+		if _, err := tx.Exec(s.query, s.args...); err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
+
+// deleteAlbumHandler removes an album together with its images: for good
+// by default, or into the trash with ?soft=true. Images also filed under
+// another album only leave this one. Nothing happens without
+// ?confirm=true, so a stray request can't wipe an album.
+func deleteAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	album := mux.Vars(r)["album"]
+	key := albumKey(album)
+	q := r.URL.Query()
+	if ok, _ := strconv.ParseBool(q.Get("confirm")); !ok {
+		writeJSONError(w, http.StatusBadRequest, "add ?confirm=true to delete the album and its images")
+		return
+	}
+	soft, _ := strconv.ParseBool(q.Get("soft"))
+
+	deleted, detached, files, err := deleteAlbum(key, !soft)
+	if err != nil {
+		log.Println("delete album error:", err)
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if len(deleted) == 0 && detached == 0 {
+		writeJSONError(w, http.StatusNotFound, "album not found")
+		return
+	}
+	// files only go once the rows are committed
+	for _, filename := range files {
+		removeImageFiles(filename)
+	}
+	for _, id := range deleted {
+		events.emit(galleryEvent{Type: "deleted", ID: id})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"album": album, "deleted": len(deleted), "detached": detached})
+}
+
+// deleteAlbum empties album key in one transaction. Images in other
+// albums too are detached, moving their primary album to another one when
+// needed; the rest are deleted like a batch delete, trashed ones included
+// when permanent. It returns the deleted ids, the number detached and the
+// files to remove.
+func deleteAlbum(key string, permanent bool) ([]string, int, []string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer tx.Rollback()
+
+	live := " AND deleted_at IS NULL"
+	if permanent {
+		live = ""
+	}
+	rows, err := tx.Query(`SELECT id, COALESCE(album, ''), (SELECT COUNT(1) FROM image_albums WHERE image_id = images.id)
+		FROM images WHERE `+albumCond(key)+live, key)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	type member struct {
+		id, primary string
+		albums      int
+	}
+	var members []member
+	for rows.Next() {
+		var m member
+		if err := rows.Scan(&m.id, &m.primary, &m.albums); err != nil {
+			rows.Close()
+			return nil, 0, nil, err
+		}
+		members = append(members, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, nil, err
+	}
+
+	var ids []string
+	detached := 0
+	for _, m := range members {
+		if key == "" || m.albums < 2 {
+			ids = append(ids, m.id)
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM image_albums WHERE image_id = ? AND album = ?", m.id, key); err != nil {
+			return nil, 0, nil, err
+		}
+		if m.primary == key {
+			if _, err := tx.Exec("UPDATE images SET album = (SELECT MIN(album) FROM image_albums WHERE image_id = ?), updated_at = ? WHERE id = ?",
+				m.id, time.Now().Unix(), m.id); err != nil {
+				return nil, 0, nil, err
+			}
+		}
+		detached++
+	}
+
+	results, files, err := deleteImagesTx(tx, ids, permanent)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	// trashed images may come back, so the album keeps its cover until then
+	if permanent {
+		if _, err := tx.Exec("DELETE FROM albums WHERE name = ?", key); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, nil, err
+	}
+	var deleted []string
+	for _, id := range ids {
+		if results[id] == "deleted" {
+			deleted = append(deleted, id)
+		}
+	}
+	return deleted, detached, files, nil
+}
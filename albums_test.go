@@ -0,0 +1,301 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNormalizeAlbum(t *testing.T) {
+	tests := []struct {
+		in, want string
+		lower    bool
+	}{
+		{"", "", false},
+		{"vacation", "vacation", false},
+		{"  summer   2024 ", "summer 2024", false},
+		{"tabs\tand\nnewlines", "tabs and newlines", false},
+		{"a/b\\c", "a-b-c", false},
+		{"bell\x07name", "bellname", false},
+		{"\x00\x1f", "", false},
+		{"Vacation", "Vacation", false},
+		{"Vacation", "vacation", true},
+		{"  ÉTÉ  Paris ", "été paris", true},
+	}
+	defer func(v bool) { lowercaseAlbums = v }(lowercaseAlbums)
+	for _, tt := range tests {
+		lowercaseAlbums = tt.lower
+		if got := normalizeAlbum(tt.in); got != tt.want {
+			t.Errorf("normalizeAlbum(%q) lower=%v = %q, want %q", tt.in, tt.lower, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeAlbums(t *testing.T) {
+	tests := []struct {
+		in, want []string
+	}{
+		{nil, []string{}},
+		{[]string{"", "  "}, []string{}},
+		{[]string{"b", "a", "b"}, []string{"b", "a"}},
+		{[]string{" trip ", "trip", "a/b"}, []string{"trip", "a-b"}},
+	}
+	for _, tt := range tests {
+		if got := normalizeAlbums(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("normalizeAlbums(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// albumsOf returns the primary album and every membership of image id.
+func albumsOf(t *testing.T, id string) (string, []string) {
+	t.Helper()
+	img, err := getImage(id)
+	if err != nil {
+		t.Fatalf("get %s: %v", id, err)
+	}
+	return img.Album, img.Albums
+}
+
+func TestAlbumMembershipTriggers(t *testing.T) {
+	openTestDB(t)
+	insertTestImage(t, "a", "trip")
+	insertTestImage(t, "u", "")
+
+	steps := []struct {
+		name        string
+		stmt        string
+		id          string
+		wantPrimary string
+		wantAlbums  []string
+	}{
+		{"insert files the primary album", "", "a", "trip", []string{"trip"}},
+		{"uncategorized has no memberships", "", "u", "", []string{}},
+		{"extra album", "INSERT INTO image_albums(image_id, album) VALUES ('a', 'beach')", "a", "trip", []string{"beach", "trip"}},
+		{"moving the primary keeps extras", "UPDATE images SET album = 'home' WHERE id = 'a'", "a", "home", []string{"beach", "home"}},
+		{"primary onto an extra", "UPDATE images SET album = 'beach' WHERE id = 'a'", "a", "beach", []string{"beach"}},
+		{"clearing the primary", "UPDATE images SET album = '' WHERE id = 'a'", "a", "", []string{}},
+		{"categorizing", "UPDATE images SET album = 'trip' WHERE id = 'u'", "u", "trip", []string{"trip"}},
+	}
+	for _, s := range steps {
+		if s.stmt != "" {
+			if _, err := db.Exec(s.stmt); err != nil {
+				t.Fatalf("%s: %v", s.name, err)
+			}
+		}
+		primary, albums := albumsOf(t, s.id)
+		if primary != s.wantPrimary || !slices.Equal(albums, s.wantAlbums) {
+			t.Errorf("%s: got %q %q, want %q %q", s.name, primary, albums, s.wantPrimary, s.wantAlbums)
+		}
+	}
+
+	if _, err := db.Exec("DELETE FROM images WHERE id = 'u'"); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(1) FROM image_albums WHERE image_id = 'u'").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d memberships left after delete", n)
+	}
+}
+
+func TestSetImageAlbums(t *testing.T) {
+	tests := []struct {
+		name        string
+		albums      []string
+		wantPrimary string
+		wantAlbums  []string
+	}{
+		{"primary listed", []string{"beach", "trip"}, "trip", []string{"beach", "trip"}},
+		{"primary not listed", []string{"home", "beach"}, "home", []string{"beach", "home"}},
+		{"only the primary", []string{"trip"}, "trip", []string{"trip"}},
+		{"empty list", []string{}, "", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			insertTestImage(t, "a", "trip")
+			if _, err := db.Exec("INSERT INTO image_albums(image_id, album) VALUES ('a', 'old')"); err != nil {
+				t.Fatal(err)
+			}
+			if err := setImageAlbums("a", tt.albums); err != nil {
+				t.Fatal(err)
+			}
+			primary, albums := albumsOf(t, "a")
+			if primary != tt.wantPrimary || !slices.Equal(albums, tt.wantAlbums) {
+				t.Errorf("got %q %q, want %q %q", primary, albums, tt.wantPrimary, tt.wantAlbums)
+			}
+		})
+	}
+}
+
+func TestRenameAlbum(t *testing.T) {
+	openTestDB(t)
+	// a and b are in "trip", b only as an extra album; c and d already
+	// sit in the target, c in both
+	insertTestImage(t, "a", "trip")
+	insertTestImage(t, "b", "home")
+	insertTestImage(t, "c", "trips")
+	insertTestImage(t, "d", "trips")
+	for _, stmt := range []string{
+		"INSERT INTO image_albums(image_id, album) VALUES ('b', 'trip'), ('c', 'trip')",
+		"UPDATE image_albums SET position = 1 WHERE image_id = 'a'",
+		"UPDATE image_albums SET position = 5 WHERE image_id = 'd'",
+		"INSERT INTO albums(name, cover_image_id) VALUES ('trip', 'a')",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := renameAlbum("trip", "trips")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 3 {
+		t.Errorf("moved %d memberships, want 3", moved)
+	}
+	want := map[string]struct {
+		primary string
+		albums  []string
+	}{
+		"a": {"trips", []string{"trips"}},
+		"b": {"home", []string{"home", "trips"}},
+		"c": {"trips", []string{"trips"}},
+		"d": {"trips", []string{"trips"}},
+	}
+	for id, w := range want {
+		primary, albums := albumsOf(t, id)
+		if primary != w.primary || !slices.Equal(albums, w.albums) {
+			t.Errorf("%s: got %q %q, want %q %q", id, primary, albums, w.primary, w.albums)
+		}
+	}
+	// moved images go after the target's manual order
+	img, _ := getImage("a")
+	if img.Position != 6 {
+		t.Errorf("position of a = %d, want 6", img.Position)
+	}
+	var cover string
+	if err := db.QueryRow("SELECT cover_image_id FROM albums WHERE name = 'trips'").Scan(&cover); err != nil || cover != "a" {
+		t.Errorf("cover of trips = %q, %v; want a", cover, err)
+	}
+
+	if moved, err := renameAlbum("nowhere", "trips"); err != nil || moved != 0 {
+		t.Errorf("renaming an empty album: %d, %v", moved, err)
+	}
+}
+
+func TestDeleteAlbum(t *testing.T) {
+	for _, permanent := range []bool{true, false} {
+		openTestDB(t)
+		// a is only in trip, b has trip as primary and home as extra,
+		// c the other way round, t was trashed earlier
+		insertTestImage(t, "a", "trip")
+		insertTestImage(t, "b", "trip")
+		insertTestImage(t, "c", "home")
+		insertTestImage(t, "t", "trip")
+		for _, stmt := range []string{
+			"INSERT INTO image_albums(image_id, album) VALUES ('b', 'home'), ('c', 'trip')",
+			"UPDATE images SET deleted_at = 1 WHERE id = 't'",
+			"INSERT INTO albums(name, cover_image_id) VALUES ('trip', 'a')",
+		} {
+			if _, err := db.Exec(stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		deleted, detached, files, err := deleteAlbum("trip", permanent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(deleted)
+		wantDeleted, wantFiles := []string{"a", "t"}, []string{"a.jpg", "t.jpg"}
+		if !permanent {
+			// the trashed image stays where it was
+			wantDeleted, wantFiles = []string{"a"}, nil
+		}
+		slices.Sort(files)
+		if !slices.Equal(deleted, wantDeleted) || detached != 2 || !slices.Equal(files, wantFiles) {
+			t.Errorf("permanent=%v: deleted %q, detached %d, files %q; want %q, 2, %q",
+				permanent, deleted, detached, files, wantDeleted, wantFiles)
+		}
+
+		for id, want := range map[string]string{"b": "home", "c": "home"} {
+			primary, albums := albumsOf(t, id)
+			if primary != want || !slices.Equal(albums, []string{"home"}) {
+				t.Errorf("permanent=%v: %s is in %q %q, want only home", permanent, id, primary, albums)
+			}
+		}
+		a, err := getImage("a")
+		if permanent && err == nil {
+			t.Error("a still exists after a permanent delete")
+		}
+		if !permanent && (err != nil || a.DeletedAt == nil) {
+			t.Errorf("a not in the trash: %v", err)
+		}
+		var covers int
+		if err := db.QueryRow("SELECT COUNT(1) FROM albums WHERE name = 'trip'").Scan(&covers); err != nil {
+			t.Fatal(err)
+		}
+		if permanent == (covers != 0) {
+			t.Errorf("permanent=%v: %d album rows left", permanent, covers)
+		}
+	}
+}
+
+func TestReorderAlbum(t *testing.T) {
+	openTestDB(t)
+	// b is only an extra member of trip; c is in both albums
+	insertTestImage(t, "a", "trip")
+	insertTestImage(t, "b", "home")
+	insertTestImage(t, "c", "home")
+	if _, err := db.Exec("INSERT INTO image_albums(image_id, album) VALUES ('b', 'trip'), ('c', 'trip')"); err != nil {
+		t.Fatal(err)
+	}
+	reorder := func(album, ids string) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(`{"ids":`+ids+`}`))
+		r = mux.SetURLVars(r, map[string]string{"album": album})
+		w := httptest.NewRecorder()
+		reorderAlbumHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("reorder %s: status %d: %s", album, w.Code, w.Body)
+		}
+	}
+	order := func(album string) []string {
+		t.Helper()
+		l, err := listImages(url.Values{"album": {album}, "sort": {"position"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, img := range l.Images {
+			ids = append(ids, img.ID)
+		}
+		return ids
+	}
+
+	if got := order("trip"); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("initial trip order %q, want members in the order they joined", got)
+	}
+	reorder("trip", `["c", "b"]`)
+	reorder("home", `["b"]`)
+	if got := order("trip"); !slices.Equal(got, []string{"c", "b", "a"}) {
+		t.Errorf("trip order %q, want c b a", got)
+	}
+	if got := order("home"); !slices.Equal(got, []string{"b", "c"}) {
+		t.Errorf("home order %q, want b c", got)
+	}
+	// a new member goes last
+	insertTestImage(t, "d", "trip")
+	if got := order("trip"); !slices.Equal(got, []string{"c", "b", "a", "d"}) {
+		t.Errorf("trip order after an upload %q, want d last", got)
+	}
+}
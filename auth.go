@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Credentials for write operations. When either is empty, writes are open
+// to anyone who can reach the server.
+var (
+	authUser = os.Getenv("GALLERY_USER")
+	authPass = os.Getenv("GALLERY_PASS")
+)
+
+func authEnabled() bool {
+	return authUser != "" && authPass != ""
+}
+
+// warnIfOpen logs at startup when write routes are unprotected.
+func warnIfOpen() {
+	if !authEnabled() {
+		log.Println("warning: GALLERY_USER/GALLERY_PASS not set; uploads and edits are open to everyone")
+	}
+}
+
+type ctxKey int
+
+// uploadLimitKey holds the upload size limit requireAuth resolved.
+const uploadLimitKey ctxKey = iota
+
+// uploadLimit returns the largest upload body allowed for r: maxUploadAuth
+// once requireAuth has authenticated the client, maxUpload otherwise.
+func uploadLimit(r *http.Request) int64 {
+	if n, ok := r.Context().Value(uploadLimitKey).(int64); ok {
+		return n
+	}
+	return maxUpload
+}
+
+// authenticated reports whether r carries the Basic Auth credentials or
+// the admin bearer token. Both are compared in constant time so a mismatch
+// does not leak how much matched.
+func authenticated(r *http.Request) bool {
+	if adminToken != "" && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(got), []byte(adminToken)) == 1
+	}
+	if !authEnabled() {
+		return false
+	}
+	user, pass, ok := r.BasicAuth()
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(authUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(authPass)) == 1
+	return ok && userOK && passOK
+}
+
+// requireAuth guards a write route with HTTP Basic Auth; the admin bearer
+// token is accepted too. Without configured credentials writes stay open.
+// It also picks the request's upload limit: authenticated clients get
+// maxUploadAuth, everyone else maxUpload.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authenticated(r) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uploadLimitKey, maxUploadAuth)))
+			return
+		}
+		if authEnabled() {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Photo Gallery", charset="UTF-8"`)
+			if strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r) {
+				writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			} else {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// runCommand handles maintenance subcommands given after the flags, e.g.
+// "photo-gallery -db gallery.db backfill-placeholders". It reports whether a
+// command ran, in which case the server is not started.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	var err error
+	switch args[0] {
+	case "backfill-placeholders", "backfill-blurhash":
+		err = backfillPlaceholders()
+	case "backfill-gps":
+		err = backfillGPS()
+	case "import":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: import <dir>")
+			os.Exit(2)
+		}
+		err = importDir(args[1])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", args[0], err)
+	}
+	return true
+}
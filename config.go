@@ -0,0 +1,253 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Runtime configuration. Each setting defaults to the value below, can be
+// overridden by an environment variable, and finally by a command-line flag.
+var (
+	addr      = ":8080"
+	imagesDir = "images"
+	thumbsDir = "thumbs"
+	dbFile    = "gallery.db"
+	logFormat = "text"
+
+	// maxDimension caps the width and height of stored originals; 0
+	// disables the check. oversizePolicy picks what happens to larger
+	// uploads: "reject" answers 413, "downscale" shrinks them to fit (GIFs
+	// are still rejected, since only their first frame would survive).
+	maxDimension   = 8000
+	oversizePolicy = oversizeReject
+
+	// stripExif re-encodes uploaded JPEGs and PNGs without their metadata.
+	stripExif = false
+
+	// uploadsPerMinute is the per-IP upload rate limit; 0 disables it.
+	uploadsPerMinute = 10
+	// trustProxy honors X-Forwarded-For for the client address. Only
+	// enable it behind a proxy that sets the header itself.
+	trustProxy = false
+
+	// maxPer is the largest page size a listing will return.
+	maxPer = 100
+
+	// corsOrigins is a comma-separated list of origins allowed to call the
+	// /api/ routes cross-origin ("*" for any); empty means same-origin only.
+	corsOrigins = ""
+
+	// lowercaseAlbums folds album names to lower case, so "Vacation" and
+	// "vacation" are the same album.
+	lowercaseAlbums = false
+
+	// Server timeouts. The read and write timeouts cover a whole request;
+	// uploads and other long transfers get transferTimeout instead.
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 60 * time.Second
+	idleTimeout       = 120 * time.Second
+	transferTimeout   = 10 * time.Minute
+
+	// Request body limits for uploads: maxUpload for anonymous clients,
+	// maxUploadAuth for ones that authenticated (see requireAuth).
+	maxUpload     int64 = 20 << 20
+	maxUploadAuth int64 = 100 << 20
+
+	// maxBytes caps the total size of stored originals; 0 means no quota.
+	maxBytes int64 = 0
+
+	// metricsEnabled exposes Prometheus metrics at /metrics.
+	metricsEnabled = false
+
+	// thumbQuality is the JPEG and WebP quality of generated thumbnails.
+	thumbQuality = defaultThumbQuality
+
+	// thumbWorkers bounds concurrent thumbnail generation; thumbWait is
+	// how long a request waits for a slot before answering 503.
+	thumbWorkers = runtime.NumCPU()
+	thumbWait    = 10 * time.Second
+
+	// Thumbnail cache limits enforced by the janitor every
+	// thumbJanitorInterval: thumbCacheBytes caps the total size and
+	// thumbMaxAge drops thumbnails not served for that long. 0 disables.
+	thumbCacheBytes      int64 = 0
+	thumbMaxAge                = time.Duration(0)
+	thumbJanitorInterval       = time.Hour
+
+	// defaultAlbum is given to uploads that don't name an album; empty
+	// keeps them uncategorized.
+	defaultAlbum = ""
+
+	// thumbOnDemand lets thumbHandler generate missing thumbnails. With it
+	// off only cached thumbnails are served and anything else is a 404.
+	thumbOnDemand = true
+
+	// thumbUpscale lets thumbnails come out larger than their source. Off,
+	// a small image's thumbnail is capped at its native size and cached
+	// under that size.
+	thumbUpscale = false
+
+	// watermarkPath names a PNG logo overlaid on every generated thumbnail
+	// at watermarkPosition with watermarkOpacity percent; empty disables
+	// it. Originals (/images/, downloads, ZIPs) get it only with
+	// watermarkOriginals.
+	watermarkPath      = ""
+	watermarkPosition  = "bottom-right"
+	watermarkOpacity   = 50
+	watermarkOriginals = false
+)
+
+const defaultThumbQuality = 80
+
+const (
+	oversizeReject    = "reject"
+	oversizeDownscale = "downscale"
+)
+
+func loadConfig() {
+	addr = envString("GALLERY_ADDR", addr)
+	imagesDir = envString("GALLERY_IMAGES_DIR", imagesDir)
+	thumbsDir = envString("GALLERY_THUMBS_DIR", thumbsDir)
+	dbFile = envString("GALLERY_DB", dbFile)
+	logFormat = envString("GALLERY_LOG_FORMAT", logFormat)
+	maxDimension = envInt("GALLERY_MAX_DIMENSION", maxDimension)
+	oversizePolicy = envString("GALLERY_OVERSIZE", oversizePolicy)
+	stripExif = envBool("GALLERY_STRIP_EXIF", stripExif)
+	uploadsPerMinute = envInt("GALLERY_UPLOADS_PER_MINUTE", uploadsPerMinute)
+	trustProxy = envBool("GALLERY_TRUST_PROXY", trustProxy)
+	maxPer = envInt("GALLERY_MAX_PER", maxPer)
+	corsOrigins = envString("GALLERY_CORS_ORIGINS", corsOrigins)
+	thumbQuality = envInt("GALLERY_THUMB_QUALITY", thumbQuality)
+	lowercaseAlbums = envBool("GALLERY_LOWERCASE_ALBUMS", lowercaseAlbums)
+	readHeaderTimeout = envDuration("GALLERY_READ_HEADER_TIMEOUT", readHeaderTimeout)
+	readTimeout = envDuration("GALLERY_READ_TIMEOUT", readTimeout)
+	writeTimeout = envDuration("GALLERY_WRITE_TIMEOUT", writeTimeout)
+	idleTimeout = envDuration("GALLERY_IDLE_TIMEOUT", idleTimeout)
+	transferTimeout = envDuration("GALLERY_TRANSFER_TIMEOUT", transferTimeout)
+	metricsEnabled = envBool("GALLERY_METRICS", metricsEnabled)
+	maxBytes = envInt64("GALLERY_MAX_BYTES", maxBytes)
+	maxUpload = envInt64("GALLERY_MAX_UPLOAD", maxUpload)
+	maxUploadAuth = envInt64("GALLERY_MAX_UPLOAD_AUTH", maxUploadAuth)
+	thumbWorkers = envInt("GALLERY_THUMB_WORKERS", thumbWorkers)
+	thumbWait = envDuration("GALLERY_THUMB_WAIT", thumbWait)
+	thumbCacheBytes = envInt64("GALLERY_THUMB_CACHE_BYTES", thumbCacheBytes)
+	thumbMaxAge = envDuration("GALLERY_THUMB_MAX_AGE", thumbMaxAge)
+	thumbJanitorInterval = envDuration("GALLERY_THUMB_JANITOR_INTERVAL", thumbJanitorInterval)
+	defaultAlbum = envString("GALLERY_DEFAULT_ALBUM", defaultAlbum)
+	thumbOnDemand = envBool("GALLERY_THUMB_ONDEMAND", thumbOnDemand)
+	thumbUpscale = envBool("GALLERY_THUMB_UPSCALE", thumbUpscale)
+	watermarkPath = envString("GALLERY_WATERMARK", watermarkPath)
+	watermarkPosition = envString("GALLERY_WATERMARK_POSITION", watermarkPosition)
+	watermarkOpacity = envInt("GALLERY_WATERMARK_OPACITY", watermarkOpacity)
+	watermarkOriginals = envBool("GALLERY_WATERMARK_ORIGINALS", watermarkOriginals)
+
+	flag.StringVar(&addr, "addr", addr, "listen address (GALLERY_ADDR)")
+	flag.StringVar(&imagesDir, "images", imagesDir, "directory for original images (GALLERY_IMAGES_DIR)")
+	flag.StringVar(&thumbsDir, "thumbs", thumbsDir, "directory for generated thumbnails (GALLERY_THUMBS_DIR)")
+	flag.StringVar(&dbFile, "db", dbFile, "path to the SQLite database (GALLERY_DB)")
+	flag.StringVar(&logFormat, "log-format", logFormat, "access log format, text or json (GALLERY_LOG_FORMAT)")
+	flag.IntVar(&maxDimension, "max-dimension", maxDimension, "largest accepted image side in pixels, 0 for no limit (GALLERY_MAX_DIMENSION)")
+	flag.StringVar(&oversizePolicy, "oversize", oversizePolicy, "reject or downscale images over -max-dimension (GALLERY_OVERSIZE)")
+	flag.BoolVar(&stripExif, "strip-exif", stripExif, "remove EXIF metadata from stored originals (GALLERY_STRIP_EXIF)")
+	flag.IntVar(&uploadsPerMinute, "uploads-per-minute", uploadsPerMinute, "per-IP upload limit, 0 for none (GALLERY_UPLOADS_PER_MINUTE)")
+	flag.BoolVar(&trustProxy, "trust-proxy", trustProxy, "take the client IP from X-Forwarded-For (GALLERY_TRUST_PROXY)")
+	flag.IntVar(&maxPer, "max-per", maxPer, "largest page size for listings (GALLERY_MAX_PER)")
+	flag.StringVar(&corsOrigins, "cors-origins", corsOrigins, "comma-separated origins allowed to call the API (GALLERY_CORS_ORIGINS)")
+	flag.IntVar(&thumbQuality, "thumb-quality", thumbQuality, "JPEG/WebP thumbnail quality, 1-100 (GALLERY_THUMB_QUALITY)")
+	flag.BoolVar(&lowercaseAlbums, "lowercase-albums", lowercaseAlbums, "store and match album names in lower case (GALLERY_LOWERCASE_ALBUMS)")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", readHeaderTimeout, "time allowed to read request headers (GALLERY_READ_HEADER_TIMEOUT)")
+	flag.DurationVar(&readTimeout, "read-timeout", readTimeout, "time allowed to read a whole request (GALLERY_READ_TIMEOUT)")
+	flag.DurationVar(&writeTimeout, "write-timeout", writeTimeout, "time allowed to write a response (GALLERY_WRITE_TIMEOUT)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "how long idle keep-alive connections stay open (GALLERY_IDLE_TIMEOUT)")
+	flag.DurationVar(&transferTimeout, "transfer-timeout", transferTimeout, "read/write time allowed for uploads and archive downloads (GALLERY_TRANSFER_TIMEOUT)")
+	flag.BoolVar(&metricsEnabled, "metrics", metricsEnabled, "serve Prometheus metrics at /metrics (GALLERY_METRICS)")
+	flag.Int64Var(&maxBytes, "max-bytes", maxBytes, "total storage quota for originals in bytes, 0 for none (GALLERY_MAX_BYTES)")
+	flag.IntVar(&thumbWorkers, "thumb-workers", thumbWorkers, "concurrent thumbnail generations (GALLERY_THUMB_WORKERS)")
+	flag.DurationVar(&thumbWait, "thumb-wait", thumbWait, "how long a thumbnail request waits for a worker before 503 (GALLERY_THUMB_WAIT)")
+	flag.Int64Var(&thumbCacheBytes, "thumb-cache-bytes", thumbCacheBytes, "evict least recently used thumbnails above this many bytes, 0 for no limit (GALLERY_THUMB_CACHE_BYTES)")
+	flag.DurationVar(&thumbMaxAge, "thumb-max-age", thumbMaxAge, "evict thumbnails not served for this long, 0 to keep them (GALLERY_THUMB_MAX_AGE)")
+	flag.DurationVar(&thumbJanitorInterval, "thumb-janitor-interval", thumbJanitorInterval, "how often the thumbnail cache limits are enforced (GALLERY_THUMB_JANITOR_INTERVAL)")
+	flag.StringVar(&defaultAlbum, "default-album", defaultAlbum, "album for uploads that don't name one (GALLERY_DEFAULT_ALBUM)")
+	flag.BoolVar(&thumbOnDemand, "thumb-ondemand", thumbOnDemand, "generate missing thumbnails on request (GALLERY_THUMB_ONDEMAND)")
+	flag.BoolVar(&thumbUpscale, "thumb-upscale", thumbUpscale, "enlarge sources smaller than the requested thumbnail size (GALLERY_THUMB_UPSCALE)")
+	flag.Int64Var(&maxUpload, "max-upload", maxUpload, "largest upload request in bytes for anonymous clients (GALLERY_MAX_UPLOAD)")
+	flag.Int64Var(&maxUploadAuth, "max-upload-auth", maxUploadAuth, "largest upload request in bytes for authenticated clients (GALLERY_MAX_UPLOAD_AUTH)")
+	flag.StringVar(&watermarkPath, "watermark", watermarkPath, "PNG logo overlaid on thumbnails, empty for none (GALLERY_WATERMARK)")
+	flag.StringVar(&watermarkPosition, "watermark-position", watermarkPosition, "top-left, top-right, bottom-left, bottom-right or center (GALLERY_WATERMARK_POSITION)")
+	flag.IntVar(&watermarkOpacity, "watermark-opacity", watermarkOpacity, "watermark opacity in percent, 1-100 (GALLERY_WATERMARK_OPACITY)")
+	flag.BoolVar(&watermarkOriginals, "watermark-originals", watermarkOriginals, "also watermark originals served from /images/, downloads and ZIPs (GALLERY_WATERMARK_ORIGINALS)")
+	flag.Parse()
+
+	if thumbQuality < 1 || thumbQuality > 100 {
+		log.Printf("thumbnail quality %d out of range 1-100, using %d", thumbQuality, defaultThumbQuality)
+		thumbQuality = defaultThumbQuality
+	}
+	// stored like any other album name, so filters match it
+	defaultAlbum = normalizeAlbum(defaultAlbum)
+	if thumbJanitorInterval <= 0 {
+		thumbJanitorInterval = time.Hour
+	}
+	if thumbWorkers < 1 {
+		thumbWorkers = runtime.NumCPU()
+	}
+	if !watermarkPositions[watermarkPosition] {
+		log.Printf("unknown watermark position %q, using bottom-right", watermarkPosition)
+		watermarkPosition = "bottom-right"
+	}
+	if watermarkOpacity < 1 || watermarkOpacity > 100 {
+		log.Printf("watermark opacity %d out of range 1-100, using 50", watermarkOpacity)
+		watermarkOpacity = 50
+	}
+}
+
+// envInt is envString for integers; unparsable values are ignored.
+func envInt(key string, def int) int {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+// envInt64 is envInt for 64-bit values such as byte sizes.
+func envInt64(key string, def int64) int64 {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+// envBool is envString for booleans; unparsable values are ignored.
+func envBool(key string, def bool) bool {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+// envString returns the environment variable key, or def when it is unset.
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
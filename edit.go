@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+	"github.com/gorilla/mux"
+)
+
+// editQuality is the JPEG/WebP quality used when an edited original is
+// written back. It matches imaging's default for JPEG.
+const editQuality = 95
+
+// imageEdit transforms a decoded original. Returning an *uploadFailure
+// rejects the edit with that status.
+type imageEdit func(image.Image) (image.Image, error)
+
+// rotateHandler turns a stored original clockwise by the "degrees" in the
+// JSON body, one of 90, 180 or 270.
+func rotateHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Degrees int `json:"degrees"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	// imaging rotates counter-clockwise
+	var rotate func(image.Image) *image.NRGBA
+	switch body.Degrees {
+	case 90:
+		rotate = imaging.Rotate270
+	case 180:
+		rotate = imaging.Rotate180
+	case 270:
+		rotate = imaging.Rotate90
+	default:
+		writeJSONError(w, http.StatusBadRequest, "degrees must be 90, 180 or 270")
+		return
+	}
+	editImageHandler(w, mux.Vars(r)["id"], false, func(img image.Image) (image.Image, error) {
+		return rotate(img), nil
+	})
+}
+
+// cropHandler cuts the pixel rectangle {"x","y","w","h"} out of a stored
+// original. With "copy": true the crop becomes a new image with the same
+// title, description, album and tags, and the original is kept.
+func cropHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		X    int  `json:"x"`
+		Y    int  `json:"y"`
+		W    int  `json:"w"`
+		H    int  `json:"h"`
+		Copy bool `json:"copy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if body.X < 0 || body.Y < 0 || body.W <= 0 || body.H <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "x and y must be >= 0, w and h > 0")
+		return
+	}
+	editImageHandler(w, mux.Vars(r)["id"], body.Copy, func(img image.Image) (image.Image, error) {
+		b := img.Bounds()
+		rect := image.Rect(body.X, body.Y, body.X+body.W, body.Y+body.H).Add(b.Min)
+		if !rect.In(b) {
+			msg := fmt.Sprintf("crop rectangle outside the %dx%d image", b.Dx(), b.Dy())
+			return nil, &uploadFailure{http.StatusBadRequest, msg}
+		}
+		return imaging.Crop(img, rect), nil
+	})
+}
+
+// editImageHandler applies edit to the original of image id and answers
+// with the updated row, or with a new row (201) when asCopy is set.
+func editImageHandler(w http.ResponseWriter, id string, asCopy bool, edit imageEdit) {
+	img, err := getImage(id)
+	if err == sql.ErrNoRows || (err == nil && img.DeletedAt != nil) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	status := http.StatusOK
+	if asCopy {
+		var dup bool
+		img, dup, err = saveEditedCopy(img, edit)
+		if err == nil && !dup {
+			status = http.StatusCreated
+		}
+	} else {
+		err = rewriteImage(img, edit)
+		if err == nil {
+			img, err = getImage(id)
+		}
+	}
+	if err != nil {
+		if f, ok := err.(*uploadFailure); ok {
+			writeJSONError(w, f.Status, f.Msg)
+			return
+		}
+		log.Printf("edit %s: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to edit image")
+		return
+	}
+
+	img.Tags, _ = imageTags(img.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(img)
+}
+
+// renderEdit decodes the stored original of row, runs edit over it and
+// writes the result to a temp file in the same format. The caller removes
+// the file.
+func renderEdit(row ImageRow, edit imageEdit) (string, image.Image, error) {
+	filename := filepath.Base(row.Filename)
+	src, err := imageStore.Open(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	defer src.Close()
+	// imaging.Open wants a path, and the extension picks the encoder back
+	tmp, err := os.CreateTemp("", "edit-*"+filepath.Ext(filename))
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	var img image.Image
+	if err == nil {
+		img, err = imaging.Open(tmp.Name())
+	}
+	if err == nil {
+		img, err = edit(img)
+	}
+	if err == nil {
+		err = saveEdited(img, tmp.Name())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), img, nil
+}
+
+// rewriteImage replaces the stored original of row with its edited
+// version, the way a file replacement does: the checksum follows the new
+// bytes, thumbnails are dropped and placeholders recomputed.
+func rewriteImage(row ImageRow, edit imageEdit) error {
+	path, img, err := renderEdit(row, edit)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if other, err := findByChecksum(sum); err == nil && other.ID != row.ID {
+		return &uploadFailure{http.StatusConflict, "identical image already exists as " + other.ID}
+	}
+
+	filename := filepath.Base(row.Filename)
+	staleThumbs := thumbVariants(filename)
+	b := img.Bounds()
+	err = swapOriginal(filename, path, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE images SET width = ?, height = ?, checksum = ?, size_bytes = ?, blurhash = NULL, dominant_color = NULL, updated_at = ? WHERE id = ?`,
+			b.Dx(), b.Dy(), sum, fi.Size(), time.Now().Unix(), row.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	removeThumbNames(staleThumbs)
+	go processUpload(row.ID, filename)
+	return nil
+}
+
+// fileChecksum returns the hex SHA-256 of the file at path, as stageUpload
+// records it for uploads.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// saveEditedCopy stores the edited version of row as a new image through
+// the regular upload path. Re-encoding drops EXIF, so the capture time and
+// position are carried over from row.
+func saveEditedCopy(row ImageRow, edit imageEdit) (ImageRow, bool, error) {
+	path, _, err := renderEdit(row, edit)
+	if err != nil {
+		return ImageRow{}, false, err
+	}
+	defer os.Remove(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return ImageRow{}, false, err
+	}
+	st, err := stageUpload(f)
+	f.Close()
+	if err != nil {
+		return ImageRow{}, false, err
+	}
+	defer os.Remove(st.Path)
+	st.Name = row.OriginalName
+
+	tags, _ := imageTags(row.ID)
+	meta := uploadMeta{Title: row.Title, Description: row.Description, Album: row.Album, Tags: tags}
+	img, dup, err := saveUpload(st, meta)
+	if err != nil || dup {
+		return img, dup, err
+	}
+	if len(row.Albums) > 1 {
+		if err := setImageAlbums(img.ID, row.Albums); err != nil {
+			log.Println("db update error:", err)
+		} else {
+			img.Albums = row.Albums
+		}
+	}
+	if _, err := db.Exec("UPDATE images SET taken_at = ?, lat = ?, lng = ? WHERE id = ?",
+		row.TakenAt.Unix(), row.Lat, row.Lng, img.ID); err != nil {
+		log.Println("db update error:", err)
+	} else {
+		img.TakenAt, img.Lat, img.Lng = row.TakenAt, row.Lat, row.Lng
+	}
+	go processUpload(img.ID, img.Filename)
+	ev := img
+	events.emit(galleryEvent{Type: "uploaded", ID: img.ID, Image: &ev})
+	return img, false, nil
+}
+
+// saveEdited writes img to path in the format its extension names.
+// imaging has no WebP encoder, so that format is handled separately.
+func saveEdited(img image.Image, path string) error {
+	if !strings.EqualFold(filepath.Ext(path), ".webp") {
+		return imaging.Save(img, path, imaging.JPEGQuality(editQuality))
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := webp.Encode(f, img, &webp.Options{Quality: editQuality}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
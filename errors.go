@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// renderError answers a failed request in the form the client asked for:
+// JSON for API routes and JSON clients, the templates/<status>.html page
+// for browsers, and plain text otherwise or when there is no such page.
+func renderError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r) {
+		writeJSONError(w, status, msg)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") && templates != nil {
+		name := fmt.Sprintf("%d.html", status)
+		if templates.Lookup(name) == nil && status >= 500 {
+			name = "500.html"
+		}
+		if templates.Lookup(name) != nil {
+			// render first, so a template error can still fall back
+			var buf bytes.Buffer
+			data := map[string]interface{}{"Status": status, "StatusText": http.StatusText(status), "Message": msg}
+			err := templates.ExecuteTemplate(&buf, name, data)
+			if err == nil {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(status)
+				_, _ = buf.WriteTo(w)
+				return
+			}
+			log.Printf("render %s: %v", name, err)
+		}
+	}
+	http.Error(w, msg, status)
+}
+
+// notFoundHandler is used for routes that do not exist.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, http.StatusNotFound, "page not found")
+}
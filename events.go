@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventHeartbeat is how often idle event streams get a comment line, so
+// proxies and browsers don't drop the connection.
+const eventHeartbeat = 25 * time.Second
+
+// galleryEvent is one message on /api/events.
+type galleryEvent struct {
+	Type  string    `json:"type"` // "uploaded" or "deleted"
+	ID    string    `json:"id"`
+	Image *ImageRow `json:"image,omitempty"`
+}
+
+// eventHub fans events out to every connected /api/events client.
+// Handlers publish into a channel; run delivers them to the clients.
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[chan galleryEvent]struct{}
+	publish chan galleryEvent
+}
+
+var events = &eventHub{
+	clients: map[chan galleryEvent]struct{}{},
+	publish: make(chan galleryEvent, 64),
+}
+
+// run broadcasts published events until the process exits.
+func (h *eventHub) run() {
+	for ev := range h.publish {
+		h.mu.Lock()
+		for c := range h.clients {
+			select {
+			case c <- ev:
+			default:
+				// a slow client misses the event rather than stalling everyone
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// emit queues an event without ever blocking the calling handler.
+func (h *eventHub) emit(ev galleryEvent) {
+	select {
+	case h.publish <- ev:
+	default:
+		log.Println("event queue full, dropping", ev.Type, ev.ID)
+	}
+}
+
+func (h *eventHub) subscribe() chan galleryEvent {
+	c := make(chan galleryEvent, 16)
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+	return c
+}
+
+func (h *eventHub) unsubscribe(c chan galleryEvent) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+}
+
+// eventsHandler streams upload and delete events as Server-Sent Events.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	// the stream outlives the server-wide write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Println("clear write deadline:", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	c := events.subscribe()
+	defer events.unsubscribe(c)
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-c:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Println("encode event:", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/xml"
+	"html"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// feedEntries is how many images an album feed lists by default.
+const feedEntries = 20
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Summary   string      `xml:"summary,omitempty"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// albumFeedHandler serves an Atom feed of the newest images in an album,
+// newest first (n entries, default feedEntries).
+func albumFeedHandler(w http.ResponseWriter, r *http.Request) {
+	album := mux.Vars(r)["album"]
+	n := atoiDefault(r.URL.Query().Get("n"), feedEntries)
+	if n < 1 {
+		n = feedEntries
+	}
+	n = clampPer(n)
+
+	where, args := imageFilter{Albums: []string{albumKey(album)}}.where()
+	rows, err := db.Query("SELECT "+imageColumns+" FROM images"+where+" ORDER BY created_at DESC, id DESC LIMIT ?", append(args, n)...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	defer rows.Close()
+	var images []ImageRow
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			continue
+		}
+		images = append(images, img)
+	}
+	rows.Close()
+	if len(images) == 0 {
+		writeJSONError(w, http.StatusNotFound, "album not found")
+		return
+	}
+
+	base := requestBase(r)
+	feed := atomFeed{
+		ID:    base + r.URL.Path,
+		Title: "Photo Gallery: " + album,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + r.URL.Path},
+			{Rel: "alternate", Type: "text/html", Href: base + "/?album=" + url.QueryEscape(album)},
+		},
+	}
+	var updated time.Time
+	for _, img := range images {
+		if img.UpdatedAt.After(updated) {
+			updated = img.UpdatedAt
+		}
+		feed.Entries = append(feed.Entries, feedEntry(base, img))
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log.Println("feed encode error:", err)
+		writeJSONError(w, http.StatusInternalServerError, "feed error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(out)
+}
+
+// feedEntry turns an image into an Atom entry linking to its share page,
+// with the original as enclosure and the thumbnail in the content.
+func feedEntry(base string, img ImageRow) atomEntry {
+	title := img.Title
+	if title == "" {
+		title = friendlyName(img)
+	}
+	page := base + "/api/images/" + url.PathEscape(img.ID)
+	if img.Slug != "" {
+		page = base + "/i/" + url.PathEscape(img.Slug)
+	}
+	full := base + "/images/" + url.PathEscape(img.Filename)
+	thumb := base + "/thumb/400x300/" + url.PathEscape(img.Filename)
+	return atomEntry{
+		ID:        "urn:uuid:" + img.ID,
+		Title:     title,
+		Published: img.CreatedAt.UTC().Format(time.RFC3339),
+		Updated:   img.UpdatedAt.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "alternate", Href: page},
+			{Rel: "enclosure", Type: mime.TypeByExtension(filepath.Ext(img.Filename)), Href: full},
+		},
+		Summary: img.Description,
+		Content: atomContent{
+			Type: "html",
+			Body: `<a href="` + html.EscapeString(page) + `"><img src="` + html.EscapeString(thumb) + `" alt="` + html.EscapeString(title) + `"></a>`,
+		},
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// fetchTimeout bounds the whole remote fetch of an upload by URL.
+const fetchTimeout = 30 * time.Second
+
+// errPrivateAddress rejects fetches that resolve to an address on this
+// host or the local network.
+var errPrivateAddress = errors.New("address not allowed")
+
+// sharedAddressSpace is the carrier-grade NAT range (100.64.0.0/10), which
+// netip does not count as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddress reports whether ip is a routable, non-local address.
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+// fetchClient only connects to public addresses. The check runs on the
+// resolved address at dial time, so redirects and DNS rebinding can't
+// reach internal services either.
+var fetchClient = &http.Client{
+	Timeout: fetchTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				ap, err := netip.ParseAddrPort(address)
+				if err != nil || !publicAddress(ap.Addr()) {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("unsupported redirect scheme")
+		}
+		return nil
+	},
+}
+
+// uploadURLHandler adds an image fetched from a remote URL, treating it
+// exactly like a form upload of that file.
+func uploadURLHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URL         string   `json:"url"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Album       string   `json:"album"`
+		Tags        []string `json:"tags"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFieldSize)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	u, err := url.Parse(strings.TrimSpace(body.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeJSONError(w, http.StatusBadRequest, "url must be an absolute http or https URL")
+		return
+	}
+	if utf8.RuneCountInString(body.Description) > maxDescription {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("description exceeds %d characters", maxDescription))
+		return
+	}
+
+	st, err := fetchImage(r.Context(), u, uploadLimit(r))
+	if err != nil {
+		log.Printf("upload url %q: %v", u.Redacted(), err)
+		uploadsTotal.WithLabelValues("failed").Inc()
+		writeJSONError(w, failureStatus(err), err.Error())
+		return
+	}
+	defer os.Remove(st.Path)
+
+	meta := uploadMeta{
+		Title:       body.Title,
+		Description: body.Description,
+		Album:       normalizeAlbum(body.Album),
+		Tags:        normalizeTags(body.Tags),
+	}
+	img, dup, err := saveUpload(st, meta)
+	if err != nil {
+		log.Printf("upload url %q: %v", u.Redacted(), err)
+		uploadsTotal.WithLabelValues("failed").Inc()
+		writeJSONError(w, failureStatus(err), err.Error())
+		return
+	}
+	status := http.StatusCreated
+	if dup {
+		uploadsTotal.WithLabelValues("duplicate").Inc()
+		status = http.StatusOK
+	} else {
+		uploadsTotal.WithLabelValues("created").Inc()
+		go processUpload(img.ID, img.Filename)
+		ev := img
+		events.emit(galleryEvent{Type: "uploaded", ID: img.ID, Image: &ev})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(img)
+}
+
+// fetchImage downloads u into a staged upload. Non-image responses,
+// bodies over limit and local addresses are rejected as *uploadFailure.
+func fetchImage(ctx context.Context, u *url.URL, limit int64) (*stagedUpload, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, &uploadFailure{http.StatusBadRequest, "invalid url"}
+	}
+	req.Header.Set("Accept", "image/*")
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			return nil, &uploadFailure{http.StatusBadRequest, "url points to a private or local address"}
+		}
+		return nil, &uploadFailure{http.StatusBadGateway, "unable to fetch url"}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &uploadFailure{http.StatusBadGateway, fmt.Sprintf("remote answered %d", resp.StatusCode)}
+	}
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); !strings.HasPrefix(ct, "image/") {
+		return nil, &uploadFailure{http.StatusUnsupportedMediaType, "url is not an image"}
+	}
+	if resp.ContentLength > limit {
+		return nil, uploadTooLarge(limit)
+	}
+
+	// one byte over the limit is enough to know the body is too large
+	st, err := stageUpload(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if st.Size > limit {
+		os.Remove(st.Path)
+		return nil, uploadTooLarge(limit)
+	}
+	st.Name = path.Base(u.Path)
+	return st, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// geoFeature is one GeoJSON point in the /api/map response.
+type geoFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoPoint               `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"` // GeoJSON order: lng, lat
+}
+
+// apiMapHandler returns every image with GPS coordinates as a GeoJSON
+// FeatureCollection. It accepts the same filters as /api/images. With
+// stripExif the collection is always empty.
+func apiMapHandler(w http.ResponseWriter, r *http.Request) {
+	where, args := filterFromQuery(r.URL.Query()).where()
+	if stripExif {
+		where += " AND 0"
+	}
+	rows, err := db.Query("SELECT id, filename, COALESCE(title, ''), COALESCE(album, ''), lat, lng FROM images"+where+
+		" AND lat IS NOT NULL AND lng IS NOT NULL ORDER BY COALESCE(taken_at, created_at) DESC", args...)
+	if err != nil {
+		log.Println("map query error:", err)
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	defer rows.Close()
+
+	features := []geoFeature{}
+	for rows.Next() {
+		var id, filename, title, album string
+		var lat, lng float64
+		if err := rows.Scan(&id, &filename, &title, &album, &lat, &lng); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		features = append(features, geoFeature{
+			Type:     "Feature",
+			Geometry: geoPoint{Type: "Point", Coordinates: [2]float64{lng, lat}},
+			Properties: map[string]interface{}{
+				"id":        id,
+				"title":     title,
+				"album":     album,
+				"url":       "/images/" + url.PathEscape(filename),
+				"thumbnail": "/thumb/300x300/" + url.PathEscape(filename),
+			},
+		})
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":     "FeatureCollection",
+		"features": features,
+	})
+}
+
+// backfillGPS reads coordinates from the stored originals of images that
+// have none yet. Originals that were auto-oriented or stripped on upload
+// no longer carry EXIF, so they stay without a position.
+func backfillGPS() error {
+	if stripExif {
+		return errors.New("GPS positions are not recorded with -strip-exif")
+	}
+	rows, err := db.Query("SELECT id, filename FROM images WHERE lat IS NULL OR lng IS NULL")
+	if err != nil {
+		return err
+	}
+	type pending struct{ id, filename string }
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.filename); err != nil {
+			rows.Close()
+			return err
+		}
+		todo = append(todo, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	done := 0
+	for _, p := range todo {
+		lat, lng, ok := storedGPS(p.filename)
+		if !ok {
+			continue
+		}
+		if _, err := db.Exec("UPDATE images SET lat = ?, lng = ? WHERE id = ?", lat, lng, p.id); err != nil {
+			return err
+		}
+		done++
+	}
+	log.Printf("gps backfill: %d of %d images had coordinates", done, len(todo))
+	return nil
+}
+
+// storedGPS is exifGPS for a file in imageStore.
+func storedGPS(filename string) (lat, lng float64, ok bool) {
+	f, err := imageStore.Open(filename)
+	if err != nil {
+		log.Printf("gps %s: %v", filename, err)
+		return 0, 0, false
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		return 0, 0, false
+	}
+	return gpsOf(x)
+}
@@ -3,9 +3,24 @@ module github.com/you/photo-gallery
 go 1.25
 
 require (
-    github.com/disintegration/imaging v1.6.2
-    github.com/gorilla/mux v1.8.0
-    github.com/google/uuid v1.6.0
-    modernc.org/sqlite v1.28.1
+	github.com/chai2010/webp v1.1.1
+	github.com/disintegration/imaging v1.6.2
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/mux v1.8.0
+	github.com/prometheus/client_golang v1.19.0
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	golang.org/x/image v0.18.0
+	golang.org/x/sync v0.7.0
+	golang.org/x/time v0.5.0
+	modernc.org/sqlite v1.28.1
 )
 
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
+)
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// readExif decodes the EXIF block of the file at path, if it has one.
+func readExif(path string) (*exif.Exif, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return exif.Decode(f)
+}
+
+// exifOrientation returns the EXIF Orientation tag of the file at path,
+// or 1 (normal) when the file carries no usable orientation.
+func exifOrientation(path string) int {
+	x, err := readExif(path)
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// exifTakenAt returns the EXIF DateTimeOriginal of the file at path, the
+// moment the shutter fired. EXIF carries no zone, so it is read as local
+// time. ok is false when the tag is missing or unparseable.
+func exifTakenAt(path string) (t time.Time, ok bool) {
+	x, err := readExif(path)
+	if err != nil {
+		return t, false
+	}
+	tag, err := x.Get(exif.DateTimeOriginal)
+	if err != nil {
+		return t, false
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return t, false
+	}
+	t, err = time.ParseInLocation("2006:01:02 15:04:05", strings.TrimRight(s, "\x00 "), time.Local)
+	if err != nil || t.Year() < 1900 {
+		return t, false
+	}
+	return t, true
+}
+
+// exifGPS returns the EXIF GPS position of the file at path. ok is false
+// when the file has no usable coordinates.
+func exifGPS(path string) (lat, lng float64, ok bool) {
+	x, err := readExif(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	return gpsOf(x)
+}
+
+// gpsOf extracts a plausible latitude/longitude pair from decoded EXIF.
+// 0,0 is what many cameras write without a fix, so it counts as missing.
+func gpsOf(x *exif.Exif) (lat, lng float64, ok bool) {
+	lat, lng, err := x.LatLong()
+	if err != nil || math.IsNaN(lat) || math.IsNaN(lng) {
+		return 0, 0, false
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 || (lat == 0 && lng == 0) {
+		return 0, 0, false
+	}
+	return lat, lng, true
+}
+
+// autoOrient rewrites the image at path so its pixels are physically in
+// display orientation. Re-encoding drops the EXIF block, so the tag can't
+// be applied twice. Files without an orientation tag are left untouched.
+func autoOrient(path string) error {
+	if exifOrientation(path) == 1 {
+		return nil
+	}
+	img, err := imaging.Open(path, imaging.AutoOrientation(true))
+	if err != nil {
+		return err
+	}
+	return imaging.Save(img, path)
+}
+
+// stripMetadata re-encodes JPEG and PNG files so no EXIF (GPS position,
+// device info, ...) survives in the stored original. The pixels are taken
+// as-is, so run autoOrient first or the rotation is lost with the tag.
+// JPEGs without an EXIF block are left alone to avoid a needless re-encode.
+func stripMetadata(path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		if _, err := readExif(path); err != nil {
+			return nil
+		}
+	case ".png":
+	default:
+		return nil
+	}
+	img, err := imaging.Open(path)
+	if err != nil {
+		return err
+	}
+	return imaging.Save(img, path)
+}
+
+// downscale shrinks the image at path in place so neither side exceeds max.
+// It is written back in the format its extension names, WebP included.
+func downscale(path string, max int) error {
+	img, err := imaging.Open(path, imaging.AutoOrientation(true))
+	if err != nil {
+		return err
+	}
+	return saveEdited(imaging.Fit(img, max, max, imaging.Lanczos), path)
+}
+
+// imageDimensions decodes only the header of the image at path.
+func imageDimensions(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// decodeImage decodes a stored original for thumbnails and placeholders.
+// The format is taken from the data rather than the file name. GIFs are
+// decoded frame by frame and only the first frame is used, composed onto
+// the full logical screen so a partial first frame does not come out blank.
+func decodeImage(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if format != "gif" {
+		return imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) == 0 {
+		return nil, errors.New("gif has no frames")
+	}
+	frame := g.Image[0]
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = frame.Bounds()
+	}
+	canvas := image.NewNRGBA(bounds)
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	return canvas, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importDir walks dir and adds every image in it to the gallery, using the
+// name of the folder holding each file as its album and the file name as
+// its title. Non-images and content that is already in the gallery are
+// skipped.
+func importDir(dir string) error {
+	var imported, skipped, failed int
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("import %s: %v", path, err)
+			failed++
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		switch err := importFile(path); {
+		case err == errImportSkipped:
+			skipped++
+		case err != nil:
+			log.Printf("import %s: %v", path, err)
+			failed++
+		default:
+			imported++
+			if imported%100 == 0 {
+				log.Printf("import: %d images so far", imported)
+			}
+		}
+		return nil
+	})
+	log.Printf("import: %d imported, %d skipped, %d failed", imported, skipped, failed)
+	return err
+}
+
+// errImportSkipped marks a file importFile left alone on purpose.
+var errImportSkipped = &uploadFailure{Msg: "skipped"}
+
+func importFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	st, err := stageUpload(f)
+	f.Close()
+	if err != nil {
+		if failureStatus(err) == http.StatusUnsupportedMediaType {
+			return errImportSkipped
+		}
+		return err
+	}
+	st.Name = filepath.Base(path)
+	defer os.Remove(st.Path)
+	if _, err := findByChecksum(st.Checksum); err == nil {
+		return errImportSkipped
+	}
+
+	base := filepath.Base(path)
+	meta := uploadMeta{
+		Title: strings.TrimSuffix(base, filepath.Ext(base)),
+		Album: normalizeAlbum(filepath.Base(filepath.Dir(path))),
+	}
+	img, dup, err := saveUpload(st, meta)
+	if err != nil {
+		return err
+	}
+	if dup {
+		return errImportSkipped
+	}
+	processUpload(img.ID, img.Filename)
+	return nil
+}
+
+// metadataResult reports what importMetadataHandler did with one entry.
+type metadataResult struct {
+	Filename string `json:"filename"`
+	Status   string `json:"status"` // imported, moved, exists, duplicate, missing, invalid or failed
+	ID       string `json:"id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// importMetadataHandler adopts originals copied into imagesDir by hand,
+// from a JSON array of {"filename", "title", "album"}. Files that already
+// have a row are skipped. The others are validated, hashed and measured
+// like uploads. A file whose name is a safe stored name (storedFilename)
+// gets its row as is, under that name. Other names, and files that
+// auto-orientation, -strip-exif or the size limit would have to rewrite,
+// are moved in under a generated name as an upload would be: the copy is
+// stored, and the hand-copied file is deleted once its row exists. Content
+// already in the gallery is reported as a duplicate and its file is left
+// alone.
+func importMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	var entries []struct {
+		Filename string `json:"filename"`
+		Title    string `json:"title"`
+		Album    string `json:"album"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if len(entries) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "no entries")
+		return
+	}
+
+	results := make([]metadataResult, 0, len(entries))
+	for _, e := range entries {
+		meta := uploadMeta{Title: e.Title, Album: normalizeAlbum(e.Album)}
+		results = append(results, importMetadataEntry(e.Filename, meta))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+func importMetadataEntry(name string, meta uploadMeta) metadataResult {
+	res := metadataResult{Filename: name}
+	// only plain names directly under imagesDir
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		res.Status = "invalid"
+		return res
+	}
+	var id string
+	err := db.QueryRow("SELECT id FROM images WHERE filename = ?", name).Scan(&id)
+	if err == nil {
+		res.Status, res.ID = "exists", id
+		return res
+	}
+	if err != sql.ErrNoRows {
+		res.Status, res.Error = "failed", "db error"
+		return res
+	}
+
+	f, err := imageStore.Open(name)
+	if err != nil {
+		res.Status = "missing"
+		return res
+	}
+	st, err := stageUpload(f)
+	f.Close()
+	if err != nil {
+		res.Status, res.Error = "failed", err.Error()
+		return res
+	}
+	defer os.Remove(st.Path)
+	st.Name = name
+	// adopt the file where it is when it can be served under its name
+	// and the upload pipeline would not change it
+	inPlace := storedFilename.MatchString(name) && strings.EqualFold(filepath.Ext(name), st.Ext) &&
+		exifOrientation(st.Path) == 1 && !stripExif && !st.oversized
+	if inPlace {
+		st.Stored = name
+	}
+	if meta.Title == "" {
+		meta.Title = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+
+	img, dup, err := saveUpload(st, meta)
+	if err != nil {
+		log.Printf("import metadata %s: %v", name, err)
+		res.Status, res.Error = "failed", err.Error()
+		return res
+	}
+	res.ID = img.ID
+	if dup {
+		res.Status = "duplicate"
+		return res
+	}
+	go processUpload(img.ID, img.Filename)
+	ev := img
+	events.emit(galleryEvent{Type: "uploaded", ID: img.ID, Image: &ev})
+	res.Status = "imported"
+	if !inPlace {
+		// the row points at the copy; the hand-copied file is now an orphan
+		res.Status = "moved"
+		if err := imageStore.Delete(name); err != nil {
+			log.Printf("import metadata %s: remove source: %v", name, err)
+		}
+	}
+	return res
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// thumbAccess remembers when each cached thumbnail was last served. File
+// access times are unreliable (noatime, relatime), so the janitor uses
+// these and falls back to the modification time for thumbnails not served
+// since the process started.
+var thumbAccess sync.Map // thumbnail name -> time.Time
+
+// touchThumb records that the thumbnail name was just served.
+func touchThumb(name string) {
+	thumbAccess.Store(name, time.Now())
+}
+
+// startThumbJanitor enforces thumbMaxAge and thumbCacheBytes every
+// thumbJanitorInterval. It does nothing when neither limit is set.
+func startThumbJanitor() {
+	if thumbMaxAge <= 0 && thumbCacheBytes <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(thumbJanitorInterval)
+		defer t.Stop()
+		for range t.C {
+			if err := evictThumbs(); err != nil {
+				log.Println("thumb janitor error:", err)
+			}
+		}
+	}()
+}
+
+// evictThumbs removes thumbnails not accessed within thumbMaxAge, then the
+// least recently accessed ones until the cache fits thumbCacheBytes.
+// Thumbnails are regenerated on demand, so eviction only costs a resize.
+// Like cleanupOrphans it scans thumbsDir and only applies to LocalStorage.
+func evictThumbs() error {
+	entries, err := os.ReadDir(thumbsDir)
+	if err != nil {
+		return err
+	}
+	type cached struct {
+		name   string
+		size   int64
+		access time.Time
+	}
+	var files []cached
+	var total int64
+	for _, e := range entries {
+		// skip directories and thumbnails still being written
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".tmp-") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		c := cached{name: e.Name(), size: fi.Size(), access: fi.ModTime()}
+		if v, ok := thumbAccess.Load(c.name); ok && v.(time.Time).After(c.access) {
+			c.access = v.(time.Time)
+		}
+		files = append(files, c)
+		total += c.size
+	}
+	// oldest access first
+	sort.Slice(files, func(i, j int) bool { return files[i].access.Before(files[j].access) })
+
+	cutoff := time.Now().Add(-thumbMaxAge)
+	removed, freed := 0, int64(0)
+	for _, c := range files {
+		stale := thumbMaxAge > 0 && c.access.Before(cutoff)
+		over := thumbCacheBytes > 0 && total > thumbCacheBytes
+		if !stale && !over {
+			// sorted by access, so nothing later is stale either
+			break
+		}
+		if err := os.Remove(filepath.Join(thumbsDir, c.name)); err != nil && !os.IsNotExist(err) {
+			log.Println("evict thumb error:", err)
+			continue
+		}
+		thumbAccess.Delete(c.name)
+		total -= c.size
+		freed += c.size
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("thumb janitor: evicted %d thumbnails (%d bytes), cache now %d bytes", removed, freed, total)
+	}
+	return nil
+}
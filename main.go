@@ -1,66 +1,199 @@
 package main
 
 import (
-    "database/sql"
-    "encoding/json"
-    "fmt"
-    "html/template"
-    "io"
-    "log"
-    "net/http"
-    "os"
-    "path/filepath"
-    "strconv"
-    "strings"
-    "time"
-
-    _ "modernc.org/sqlite"
-
-    "github.com/disintegration/imaging"
-    "github.com/gorilla/mux"
-    "github.com/google/uuid"
-)
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	_ "modernc.org/sqlite"
 
+	"github.com/gorilla/mux"
+	_ "golang.org/x/image/webp"
+)
 
 const (
-	imagesDir     = "images"
-	thumbsDir     = "thumbs"
-	dbFile        = "gallery.db"
-	maxUploadSize = 20 << 20 // 20 MB
-	defaultPer    = 12
+	defaultPer     = 12
+	maxDescription = 2000 // characters
+	defaultLatest  = 8
+	maxLatest      = 50
 )
 
+// imageTypes maps the accepted sniffed content types to stored extensions.
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// formatOf names the image format of a sniffed content type, e.g. "jpeg"
+// for "image/jpeg".
+func formatOf(contentType string) string {
+	return strings.TrimPrefix(contentType, "image/")
+}
+
+// uncategorizedLabel is reported by /api/albums for images without an album.
+var uncategorizedLabel = "(uncategorized)"
+
 var templates *template.Template
 var db *sql.DB
 
 type ImageRow struct {
-	ID        string
-	Filename  string
-	Title     string
-	Album     string
-	CreatedAt time.Time
+	ID            string
+	Filename      string
+	OriginalName  string // sanitized client filename, for display and downloads
+	Position      int    // manual order within the primary album, see sort=position
+	Title         string
+	Slug          string
+	Description   string
+	Album         string
+	CreatedAt     time.Time
+	Width         int
+	Height        int
+	UpdatedAt     time.Time
+	Checksum      string
+	BlurHash      string
+	DominantColor string // average color as #rrggbb
+	SizeBytes     int64
+	DeletedAt     *time.Time // set while the image is in the trash
+	IsFavorite    bool
+	TakenAt       time.Time // EXIF capture time, or CreatedAt when unknown
+	Format        string    // jpeg, png, gif or webp
+	Lat, Lng      *float64  // EXIF GPS position, nil when unknown
+	ViewCount     int
+	LastViewedAt  *time.Time
+	Tags          []string
+	Albums        []string // Album plus any additional albums
+	Thumbnails    []thumbnailRef
 }
 
+// imageColumns is the select list scanned by scanImage. Dimensions are
+// NULL for rows created before they were recorded, so report them as 0.
+// Album memberships come joined with a separator album names can't hold.
+const imageColumns = "id, filename, title, album, created_at, COALESCE(width, 0), COALESCE(height, 0), COALESCE(updated_at, created_at), COALESCE(checksum, ''), COALESCE(blurhash, ''), COALESCE(dominant_color, ''), COALESCE(size_bytes, 0), deleted_at, is_favorite, COALESCE(taken_at, created_at), COALESCE(format, ''), COALESCE(description, ''), COALESCE(slug, ''), COALESCE(original_name, ''), " + primaryPosition + ", lat, lng, COALESCE(view_count, 0), last_viewed_at, COALESCE((SELECT group_concat(album, char(31)) FROM image_albums WHERE image_id = images.id), '')"
+
 func main() {
+	loadConfig()
+	warnIfOpen()
 	ensureDirs()
+	initStorage()
+	loadWatermark()
 	loadTemplates()
 	openDB()
+	if runCommand(flag.Args()) {
+		db.Close()
+		return
+	}
+
+	go events.run()
+	go recordViews()
+	startThumbJanitor()
 
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
 	// static file servers
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", http.FileServer(http.Dir(imagesDir))))
-	r.PathPrefix("/thumbs/").Handler(http.StripPrefix("/thumbs/", http.FileServer(http.Dir(thumbsDir))))
+	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", originalsHandler()))
+	r.PathPrefix("/thumbs/").Handler(http.StripPrefix("/thumbs/", storeFileServer(thumbStore)))
 
 	// routes
 	r.HandleFunc("/", galleryHandler).Methods("GET")
-	r.HandleFunc("/upload", uploadHandler).Methods("POST")
-	r.HandleFunc("/thumb/{size}/{filename}", thumbHandler).Methods("GET")
+	r.Handle("/upload", requireAuth(withTransferTimeout(withUploadLimit(http.HandlerFunc(uploadHandler))))).Methods("POST")
+	r.Handle("/api/upload-url", requireAuth(withTransferTimeout(withUploadLimit(http.HandlerFunc(uploadURLHandler))))).Methods("POST")
+	r.HandleFunc("/thumb/{size}/{filename}", thumbHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/api/images", apiImagesHandler).Methods("GET")
+	r.Handle("/api/images/move", requireAuth(http.HandlerFunc(moveImagesHandler))).Methods("POST")
+	r.Handle("/api/images/delete", requireAuth(http.HandlerFunc(batchDeleteHandler))).Methods("POST")
+	r.HandleFunc("/api/images/{id}", apiImageHandler).Methods("GET")
+	r.Handle("/api/images/{id}", requireAuth(http.HandlerFunc(deleteImageHandler))).Methods("DELETE")
+	r.Handle("/api/images/{id}", requireAuth(http.HandlerFunc(patchImageHandler))).Methods("PATCH")
+	r.Handle("/api/trash", requireAuth(http.HandlerFunc(apiTrashHandler))).Methods("GET")
+	r.Handle("/api/images/{id}/file", requireAuth(withTransferTimeout(http.HandlerFunc(replaceFileHandler)))).Methods("PUT")
+	r.Handle("/api/images/{id}/rotate", requireAuth(http.HandlerFunc(rotateHandler))).Methods("POST")
+	r.Handle("/api/images/{id}/crop", requireAuth(http.HandlerFunc(cropHandler))).Methods("POST")
+	r.Handle("/api/images/{id}/favorite", requireAuth(http.HandlerFunc(toggleFavoriteHandler))).Methods("POST")
+	r.HandleFunc("/api/images/{id}/view", viewHandler).Methods("GET", "POST")
+	r.Handle("/api/images/{id}/restore", requireAuth(http.HandlerFunc(restoreImageHandler))).Methods("POST")
+	r.HandleFunc("/api/albums", apiAlbumsHandler).Methods("GET")
+	r.Handle("/api/albums/rename", requireAuth(http.HandlerFunc(renameAlbumHandler))).Methods("POST")
+	r.Handle("/api/albums/{album}", requireAuth(http.HandlerFunc(deleteAlbumHandler))).Methods("DELETE")
+	r.Handle("/api/albums/{album}/download.zip", withTransferTimeout(http.HandlerFunc(albumZipHandler))).Methods("GET")
+	r.Handle("/api/albums/{album}/cover", requireAuth(http.HandlerFunc(setAlbumCoverHandler))).Methods("POST")
+	r.HandleFunc("/api/albums/{album}/feed.xml", albumFeedHandler).Methods("GET")
+	r.Handle("/api/albums/{album}/reorder", requireAuth(http.HandlerFunc(reorderAlbumHandler))).Methods("POST")
+	r.Handle("/api/tags/apply", requireAuth(http.HandlerFunc(applyTagsHandler))).Methods("POST")
+	r.HandleFunc("/api/search", apiSearchHandler).Methods("GET")
+	r.HandleFunc("/api/random", apiRandomHandler).Methods("GET")
+	r.HandleFunc("/api/recent", apiRecentHandler).Methods("GET")
+	r.HandleFunc("/api/latest", apiLatestHandler).Methods("GET")
+	r.HandleFunc("/api/stats", apiStatsHandler).Methods("GET")
+	r.HandleFunc("/api/formats", apiFormatsHandler).Methods("GET")
+	r.HandleFunc("/api/map", apiMapHandler).Methods("GET")
+	r.HandleFunc("/api/events", eventsHandler).Methods("GET")
+	r.HandleFunc("/api/openapi.json", openAPIHandler).Methods("GET")
+	r.HandleFunc("/i/{slug}", slugHandler).Methods("GET")
+	r.Handle("/sitemap.xml", withTransferTimeout(http.HandlerFunc(sitemapHandler))).Methods("GET")
+	r.Handle("/download/{id}", withTransferTimeout(http.HandlerFunc(downloadHandler))).Methods("GET")
+	r.HandleFunc("/healthz", healthHandler).Methods("GET")
+	if metricsEnabled {
+		r.Handle("/metrics", metricsHandler()).Methods("GET")
+	}
+
+	// maintenance
+	r.Handle("/admin/cleanup", adminAuth(http.HandlerFunc(cleanupHandler))).Methods("POST")
+	r.Handle("/admin/thumbs/regenerate", adminAuth(http.HandlerFunc(regenerateThumbsHandler))).Methods("POST")
+	r.Handle("/admin/thumbs/regenerate", adminAuth(http.HandlerFunc(regenerateStatusHandler))).Methods("GET")
+	r.Handle("/admin/trash/purge", adminAuth(http.HandlerFunc(purgeTrashHandler))).Methods("POST")
+	r.Handle("/admin/import-metadata", adminAuth(http.HandlerFunc(importMetadataHandler))).Methods("POST")
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           loggingMiddleware(gzipMiddleware(recoverMiddleware(corsMiddleware(r)))),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
 
-	addr := ":8080"
-	log.Printf("starting server on %s", addr)
-	if err := http.ListenAndServe(addr, r); err != nil {
-		log.Fatal(err)
+	go func() {
+		log.Printf("starting server on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// wait for a stop signal, then let in-flight requests finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Println("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	stopRecordingViews()
+	if err := db.Close(); err != nil {
+		log.Printf("close db: %v", err)
 	}
 }
 
@@ -81,241 +214,998 @@ func loadTemplates() {
 }
 
 func openDB() {
+	// The pragmas go in the DSN so the driver runs them on every pooled
+	// connection, not just the first one. WAL lets readers proceed while a
+	// single writer commits, busy_timeout makes competing writers wait up
+	// to 5s instead of failing with "database is locked", and NORMAL sync
+	// is durable enough in WAL mode.
+	dsn := dbFile + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"
 	var err error
-	db, err = sql.Open("sqlite3", dbFile)
+	db, err = sql.Open("sqlite", dsn)
 	if err != nil {
 		log.Fatalf("open db: %v", err)
 	}
-	create := `
-	CREATE TABLE IF NOT EXISTS images (
-	  id TEXT PRIMARY KEY,
-	  filename TEXT NOT NULL,
-	  title TEXT,
-	  album TEXT,
-	  created_at INTEGER NOT NULL
-	);
-	`
-	if _, err := db.Exec(create); err != nil {
-		log.Fatalf("create table: %v", err)
+	if err := migrate(); err != nil {
+		log.Fatalf("migrate db: %v", err)
 	}
+	// data backfills that need the stored files; rows they can't fill yet
+	// are retried on the next start
+	backfillSizes()
+	backfillFormats()
+	backfillSlugs()
 }
 
-func galleryHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	page := atoiDefault(q.Get("page"), 1)
-	per := atoiDefault(q.Get("per"), defaultPer)
-	album := q.Get("album")
-	offset := (page - 1) * per
-
-	var rows *sql.Rows
-	var err error
-	if album == "" {
-		rows, err = db.Query("SELECT id, filename, title, album, created_at FROM images ORDER BY created_at DESC LIMIT ? OFFSET ?", per, offset)
-	} else {
-		rows, err = db.Query("SELECT id, filename, title, album, created_at FROM images WHERE album = ? ORDER BY created_at DESC LIMIT ? OFFSET ?", album, per, offset)
-	}
+// backfillSizes records the file size of rows uploaded before sizes were
+// tracked. Rows whose file is missing stay NULL and are retried next start.
+func backfillSizes() {
+	rows, err := db.Query("SELECT id, filename FROM images WHERE size_bytes IS NULL")
 	if err != nil {
-		http.Error(w, "db error", 500)
-		return
+		log.Fatalf("backfill sizes: %v", err)
 	}
-	defer rows.Close()
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var id, filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			log.Fatalf("backfill sizes: %v", err)
+		}
+		fi, err := imageStore.Stat(filepath.Base(filename))
+		if err != nil {
+			log.Printf("backfill size %s: %v", filename, err)
+			continue
+		}
+		sizes[id] = fi.Size()
+	}
+	rows.Close()
+	for id, size := range sizes {
+		if _, err := db.Exec("UPDATE images SET size_bytes = ? WHERE id = ?", size, id); err != nil {
+			log.Fatalf("backfill sizes: %v", err)
+		}
+	}
+}
 
-	images := []ImageRow{}
+// backfillFormats sniffs the format of rows stored before it was recorded.
+func backfillFormats() {
+	rows, err := db.Query("SELECT id, filename FROM images WHERE format IS NULL")
+	if err != nil {
+		log.Fatalf("backfill formats: %v", err)
+	}
+	formats := map[string]string{}
 	for rows.Next() {
-		var id, filename, title, alb string
-		var createdAt int64
-		if err := rows.Scan(&id, &filename, &title, &alb, &createdAt); err != nil {
+		var id, filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			log.Fatalf("backfill formats: %v", err)
+		}
+		format, err := sniffStored(filepath.Base(filename))
+		if err != nil {
+			log.Printf("backfill format %s: %v", filename, err)
 			continue
 		}
-		images = append(images, ImageRow{
-			ID:        id,
-			Filename:  filename,
-			Title:     title,
-			Album:     alb,
-			CreatedAt: time.Unix(createdAt, 0),
-		})
+		formats[id] = format
 	}
+	rows.Close()
+	for id, format := range formats {
+		if _, err := db.Exec("UPDATE images SET format = ? WHERE id = ?", format, id); err != nil {
+			log.Fatalf("backfill formats: %v", err)
+		}
+	}
+}
 
-	// total count for pagination
-	var total int
-	if album == "" {
-		_ = db.QueryRow("SELECT COUNT(1) FROM images").Scan(&total)
-	} else {
-		_ = db.QueryRow("SELECT COUNT(1) FROM images WHERE album = ?", album).Scan(&total)
+// sniffStored detects the format of a stored original from its first bytes.
+func sniffStored(name string) (string, error) {
+	f, err := imageStore.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
 	}
+	return formatOf(http.DetectContentType(head[:n])), nil
+}
 
+// galleryHandler renders the gallery page, or answers like /api/images
+// for clients that ask for JSON.
+func galleryHandler(w http.ResponseWriter, r *http.Request) {
+	// the body depends on Accept, so shared caches must key on it
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		apiImagesHandler(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	l, err := listImages(q)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(l.Total))
+	w.Header().Set("X-Page", strconv.Itoa(l.Page))
+	w.Header().Set("X-Per", strconv.Itoa(l.Per))
+
+	// the filter box holds one album; page links carry them all
+	album := ""
+	if len(l.Filter.Albums) > 0 {
+		album = l.Filter.Albums[0]
+	}
 	data := map[string]interface{}{
-		"Images": images,
-		"Page":   page,
-		"Per":    per,
-		"Total":  total,
-		"Album":  album,
+		"Images":   l.Images,
+		"Page":     l.Page,
+		"Per":      l.Per,
+		"Total":    l.Total,
+		"Album":    album,
+		"Albums":   l.Filter.Albums,
+		"Sort":     l.Sort,
+		"From":     q.Get("from"),
+		"To":       q.Get("to"),
+		"Favorite": l.Filter.Favorite,
 	}
 	if err := templates.ExecuteTemplate(w, "index.html", data); err != nil {
-		http.Error(w, err.Error(), 500)
+		log.Println("render index:", err)
+		renderError(w, r, http.StatusInternalServerError, "template error")
 	}
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(maxUploadSize)
+func serveFileWithCache(w http.ResponseWriter, r *http.Request, store Storage, name string) {
+	stat, err := store.Stat(name)
 	if err != nil {
-		http.Error(w, "file too big or invalid form", http.StatusBadRequest)
+		renderError(w, r, http.StatusNotFound, "file not found")
 		return
 	}
-	file, header, err := r.FormFile("image")
-	if err != nil {
-		http.Error(w, "image required", http.StatusBadRequest)
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	etag := fmt.Sprintf(`W/"%d-%d"`, stat.Size(), stat.ModTime().Unix())
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if notModified(w, r, etag, stat.ModTime()) {
 		return
 	}
-	defer file.Close()
+	serveStored(w, r, store, name, stat)
+}
 
-	title := r.FormValue("title")
-	album := r.FormValue("album")
+// notModified sets the ETag and Last-Modified validators and answers 304
+// when the request's conditional headers show the client is up to date,
+// reporting whether it did.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, mod time.Time) bool {
+	w.Header().Set("Last-Modified", mod.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", etag)
+
+	// If-Modified-Since is only consulted without If-None-Match (RFC 9110)
+	if r.Header.Get("If-None-Match") != "" {
+		if etagMatches(r, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		// HTTP dates have second precision, so compare at that precision
+		if t, err := http.ParseTime(ims); err == nil {
+			if !mod.Truncate(time.Second).After(t) {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	ext := strings.ToLower(filepath.Ext(header.Filename))
-	if ext == "" {
-		ext = ".jpg"
+// etagMatches reports whether the If-None-Match header of r lists etag,
+// or is "*". Weak and strong forms of the same tag match.
+func etagMatches(r *http.Request, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
 	}
-	id := uuid.New().String()
-	filename := id + ext
-	outPath := filepath.Join(imagesDir, filename)
+	return false
+}
 
-	out, err := os.Create(outPath)
+// listingValidators derives an ETag and modification time for a listing
+// so polling clients can revalidate without the page being rendered. The
+// ETag combines the number of images matching filter with the
+// gallery_version write counter, so any change, deletions included,
+// yields a new tag; the query is folded in as every page shares the
+// aggregates. The modification time is the latest edit or view.
+func listingValidators(filter imageFilter, query string) (string, time.Time, error) {
+	where, args := filter.where()
+	var n int
+	var updated, viewed, version int64
+	err := db.QueryRow("SELECT COUNT(1), COALESCE(MAX(COALESCE(updated_at, created_at)), 0), COALESCE(MAX(last_viewed_at), 0), (SELECT COALESCE(MAX(version), 0) FROM gallery_version) FROM images"+where, args...).
+		Scan(&n, &updated, &viewed, &version)
 	if err != nil {
-		http.Error(w, "unable to save file", 500)
-		return
+		return "", time.Time{}, err
 	}
-	defer out.Close()
+	h := fnv.New32a()
+	h.Write([]byte(query))
+	return fmt.Sprintf(`W/"%d-%d-%x"`, n, version, h.Sum32()), time.Unix(max(updated, viewed), 0), nil
+}
 
-	if _, err := io.Copy(out, file); err != nil {
-		http.Error(w, "save error", 500)
+func apiImagesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if etag, mod, err := listingValidators(filterFromQuery(q), r.URL.RawQuery); err == nil {
+		// cached copies must be revalidated, which the validators make cheap
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Last-Modified", mod.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", etag)
+		// deleting an image lowers the count without a newer updated_at,
+		// so only the ETag can tell and If-Modified-Since is not honored
+		if etagMatches(r, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if q.Has("after") {
+		apiImagesCursor(w, filterFromQuery(q), clampPer(atoiDefault(q.Get("per"), defaultPer)), q.Get("after"))
 		return
 	}
 
-	_, err = db.Exec("INSERT INTO images(id, filename, title, album, created_at) VALUES(?,?,?,?,?)", id, filename, title, album, time.Now().Unix())
+	l, err := listImages(q)
 	if err != nil {
-		log.Println("db insert error:", err)
+		writeJSONError(w, http.StatusInternalServerError, "db err")
+		return
 	}
+	if err := attachTags(l.Images); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db err")
+		return
+	}
+	writeImagesPage(w, r, l.Page, l.Per, l.Total, l.Images)
+}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+// imageListing is one page of a filtered, sorted image listing.
+type imageListing struct {
+	Page, Per, Total int
+	Sort             string
+	Filter           imageFilter
+	Images           []ImageRow
 }
 
-func thumbHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	size := vars["size"]
-	filename := filepath.Base(vars["filename"])
+// listImages runs the paginated listing described by the page, per, sort
+// and filter parameters of q. The gallery page and /api/images share it.
+func listImages(q url.Values) (imageListing, error) {
+	l := imageListing{
+		Page:   atoiDefault(q.Get("page"), 1),
+		Per:    clampPer(atoiDefault(q.Get("per"), defaultPer)),
+		Filter: filterFromQuery(q),
+		Images: []ImageRow{},
+	}
+	sort, order := sortOrder(q.Get("sort"))
+	l.Sort = sort
+	offset := (l.Page - 1) * l.Per
 
-	parts := strings.Split(size, "x")
-	if len(parts) != 2 {
-		http.Error(w, "invalid size", 400)
-		return
+	where, args := l.Filter.where()
+	if sort == "position" && len(l.Filter.Albums) == 1 {
+		position, posArgs := positionIn(l.Filter.Albums[0])
+		order = position + " ASC, created_at ASC, id ASC"
+		args = append(args, posArgs...)
 	}
-	wid, err1 := strconv.Atoi(parts[0])
-	hei, err2 := strconv.Atoi(parts[1])
-	if err1 != nil || err2 != nil || wid <= 0 || hei <= 0 {
-		http.Error(w, "invalid size numbers", 400)
-		return
+	rows, err := db.Query("SELECT "+imageColumns+" FROM images"+where+" ORDER BY "+order+" LIMIT ? OFFSET ?", append(args, l.Per, offset)...)
+	if err != nil {
+		return l, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			continue
+		}
+		l.Images = append(l.Images, img)
+	}
+	rows.Close()
+	l.Total = countImages(l.Filter)
+	return l, nil
+}
+
+// apiImagesCursor lists newest-first images strictly after the cursor
+// "<created_at>_<id>", which stays stable while new uploads arrive. An
+// empty cursor starts at the newest image.
+func apiImagesCursor(w http.ResponseWriter, filter imageFilter, per int, after string) {
+	where, args := filter.where()
+	if after != "" {
+		ts, id, ok := strings.Cut(after, "_")
+		createdAt, err := strconv.ParseInt(ts, 10, 64)
+		if !ok || err != nil || id == "" {
+			writeJSONError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		if where == "" {
+			where = " WHERE (created_at, id) < (?, ?)"
+		} else {
+			where += " AND (created_at, id) < (?, ?)"
+		}
+		args = append(args, createdAt, id)
 	}
 
-	thumbName := fmt.Sprintf("%dx%d_%s", wid, hei, filename)
-	thumbPath := filepath.Join(thumbsDir, thumbName)
-	if _, err := os.Stat(thumbPath); err == nil {
-		serveFileWithCache(w, r, thumbPath)
+	// fetch one extra row to know whether another page follows
+	rows, err := db.Query("SELECT "+imageColumns+" FROM images"+where+" ORDER BY created_at DESC, id DESC LIMIT ?", append(args, per+1)...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db err")
 		return
 	}
+	defer rows.Close()
+	images := []ImageRow{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			continue
+		}
+		images = append(images, img)
+	}
+	rows.Close()
 
-	srcPath := filepath.Join(imagesDir, filename)
-	if _, err := os.Stat(srcPath); err != nil {
-		http.NotFound(w, r)
+	out := struct {
+		Per        int        `json:"per"`
+		NextCursor string     `json:"next_cursor,omitempty"`
+		Images     []ImageRow `json:"images"`
+	}{Per: per}
+	if len(images) > per {
+		images = images[:per]
+		last := images[len(images)-1]
+		out.NextCursor = fmt.Sprintf("%d_%s", last.CreatedAt.Unix(), last.ID)
+	}
+	if err := attachTags(images); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db err")
 		return
 	}
+	out.Images = images
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// imagesPage is the JSON shape shared by every paginated image listing.
+type imagesPage struct {
+	Page       int        `json:"page"`
+	Per        int        `json:"per"`
+	Total      int        `json:"total"`
+	TotalPages int        `json:"total_pages"`
+	Next       string     `json:"next,omitempty"`
+	Prev       string     `json:"prev,omitempty"`
+	Images     []ImageRow `json:"images"`
+}
+
+func writeImagesPage(w http.ResponseWriter, r *http.Request, page, per, total int, images []ImageRow) {
+	totalPages := (total + per - 1) / per
+	out := imagesPage{Page: page, Per: per, Total: total, TotalPages: totalPages, Images: images}
+	if page < totalPages {
+		out.Next = pageURL(r, page+1, per)
+	}
+	if page > 1 {
+		out.Prev = pageURL(r, page-1, per)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func apiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page := atoiDefault(q.Get("page"), 1)
+	per := clampPer(atoiDefault(q.Get("per"), defaultPer))
+	term := strings.TrimSpace(q.Get("q"))
+	_, order := sortOrder(q.Get("sort"))
+	offset := (page - 1) * per
+
+	images := []ImageRow{}
+	total := 0
+	if term != "" {
+		pattern := escapeLike(strings.ToLower(term))
+		where := ` WHERE deleted_at IS NULL AND (LOWER(title) LIKE '%' || ? || '%' ESCAPE '\' OR id IN (SELECT image_id FROM image_albums WHERE LOWER(album) LIKE '%' || ? || '%' ESCAPE '\'))`
+		rows, err := db.Query("SELECT "+imageColumns+" FROM images"+where+" ORDER BY "+order+" LIMIT ? OFFSET ?", pattern, pattern, per, offset)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "db err")
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			img, err := scanImage(rows)
+			if err != nil {
+				continue
+			}
+			images = append(images, img)
+		}
+		rows.Close()
+		_ = db.QueryRow("SELECT COUNT(1) FROM images"+where, pattern, pattern).Scan(&total)
+		if err := attachTags(images); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "db err")
+			return
+		}
+	}
+	writeImagesPage(w, r, page, per, total, images)
+}
+
+// escapeLike escapes LIKE wildcards so user input matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// sortOrders maps the accepted ?sort= values to fixed ORDER BY clauses, so
+// user input never reaches the SQL text.
+var sortOrders = map[string]string{
+	"newest":     "created_at DESC, id DESC",
+	"oldest":     "created_at ASC, id ASC",
+	"title":      "title COLLATE NOCASE ASC, created_at DESC",
+	"title_desc": "title COLLATE NOCASE DESC, created_at DESC",
+	"largest":    "COALESCE(size_bytes, 0) DESC, id DESC",
+	"smallest":   "COALESCE(size_bytes, 0) ASC, id ASC",
+	"taken":      "COALESCE(taken_at, created_at) DESC, id DESC",
+	"position":   primaryPosition + " ASC, created_at ASC, id ASC",
+}
+
+// primaryPosition is the manual position of an image within its primary
+// album. Listings of a single album order by the position there instead.
+const primaryPosition = "COALESCE((SELECT position FROM image_albums WHERE image_id = images.id AND album = images.album), position, 0)"
+
+const defaultSort = "newest"
+
+// sortOrder resolves a ?sort= value, falling back to newest-first for
+// anything unknown. It returns the effective sort name and its clause.
+func sortOrder(sort string) (string, string) {
+	if order, ok := sortOrders[sort]; ok {
+		return sort, order
+	}
+	return defaultSort, sortOrders[defaultSort]
+}
+
+// imageFilter narrows an image listing; the zero value matches everything.
+type imageFilter struct {
+	Albums   []string  // any may match; "" is the uncategorized album
+	Tags     []string  // all must be present
+	From     time.Time // created at or after, when set
+	To       time.Time // created at or before, when set
+	Favorite bool      // only starred images
+	Trashed  bool      // list soft-deleted images instead of live ones
+}
+
+func filterFromQuery(q url.Values) imageFilter {
+	f := imageFilter{
+		Albums: normalizeAlbums(q["album"]),
+		Tags:   normalizeTags(q["tag"]),
+		From:   parseDateBound(q.Get("from"), false),
+		To:     parseDateBound(q.Get("to"), true),
+	}
+	f.Favorite, _ = strconv.ParseBool(q.Get("favorite"))
+	return f
+}
+
+// parseDateBound reads a ?from/?to value given as RFC3339, a plain
+// YYYY-MM-DD date or Unix seconds. A plain date as the upper bound covers
+// that whole day. Anything unparseable yields the zero time, which drops
+// the bound instead of failing the request.
+func parseDateBound(s string, upper bool) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if upper {
+			return t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+		return t
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0)
+	}
+	return time.Time{}
+}
+
+// where renders the filter as a " WHERE ..." clause, or "" when it matches
+// everything, along with its placeholder arguments.
+func (f imageFilter) where() (string, []interface{}) {
+	conds := []string{"deleted_at IS NULL"}
+	if f.Trashed {
+		conds[0] = "deleted_at IS NOT NULL"
+	}
+	args := []interface{}{}
+	if len(f.Albums) > 0 {
+		ors := []string{}
+		for _, a := range f.Albums {
+			ors = append(ors, albumCond(a))
+			args = append(args, a)
+		}
+		conds = append(conds, "("+strings.Join(ors, " OR ")+")")
+	}
+	if f.Favorite {
+		conds = append(conds, "is_favorite = 1")
+	}
+	if !f.From.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, f.From.Unix())
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "created_at <= ?")
+		args = append(args, f.To.Unix())
+	}
+	if len(f.Tags) > 0 {
+		conds = append(conds, `id IN (SELECT it.image_id FROM image_tags it JOIN tags t ON t.id = it.tag_id
+			WHERE t.name IN (`+placeholders(len(f.Tags))+`) GROUP BY it.image_id HAVING COUNT(DISTINCT t.name) = ?)`)
+		for _, t := range f.Tags {
+			args = append(args, t)
+		}
+		args = append(args, len(f.Tags))
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// placeholders returns "?, ?, ..." with n markers.
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.Repeat("?, ", n-1) + "?"
+}
+
+// countImages returns the number of images matching filter.
+func countImages(filter imageFilter) int {
+	var total int
+	where, args := filter.where()
+	_ = db.QueryRow("SELECT COUNT(1) FROM images"+where, args...).Scan(&total)
+	return total
+}
 
-	img, err := imaging.Open(srcPath)
+// pageURL builds a link to another page of the current listing, keeping
+// every other query parameter (album, search term, ...) as it was.
+func pageURL(r *http.Request, page, per int) string {
+	q := r.URL.Query()
+	q.Set("page", strconv.Itoa(page))
+	q.Set("per", strconv.Itoa(per))
+	return r.URL.Path + "?" + q.Encode()
+}
+
+func apiAlbumsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT album, COUNT(1) FROM (" + albumMembers + ") GROUP BY album ORDER BY 1")
 	if err != nil {
-		http.Error(w, "open image failed", 500)
+		writeJSONError(w, http.StatusInternalServerError, "db err")
 		return
 	}
-	thumb := imaging.Fit(img, wid, hei, imaging.Lanczos)
+	defer rows.Close()
 
-	if err := imaging.Save(thumb, thumbPath); err != nil {
-		http.Error(w, "save thumb failed", 500)
-		return
+	type albumCount struct {
+		Album         string `json:"album"`
+		Count         int    `json:"count"`
+		CoverID       string `json:"cover_id"`
+		CoverFilename string `json:"cover_filename"`
 	}
+	albums := []albumCount{}
+	for rows.Next() {
+		var a albumCount
+		if err := rows.Scan(&a.Album, &a.Count); err != nil {
+			continue
+		}
+		albums = append(albums, a)
+	}
+	rows.Close()
+	for i := range albums {
+		a := &albums[i]
+		if id, filename, err := albumCover(a.Album); err == nil {
+			a.CoverID, a.CoverFilename = id, filename
+		}
+		if a.Album == "" {
+			a.Album = uncategorizedLabel
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(albums)
+}
 
-	serveFileWithCache(w, r, thumbPath)
+func apiImageHandler(w http.ResponseWriter, r *http.Request) {
+	img, err := getImage(mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if img.Tags, err = imageTags(img.ID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(img)
 }
 
-func serveFileWithCache(w http.ResponseWriter, r *http.Request, path string) {
-	stat, err := os.Stat(path)
+// deleteImageHandler moves an image to the trash. The row and files stay
+// until the trash is purged, so the delete can be undone.
+func deleteImageHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	res, err := db.Exec("UPDATE images SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", time.Now().Unix(), id)
 	if err != nil {
-		http.NotFound(w, r)
+		writeJSONError(w, http.StatusInternalServerError, "db error")
 		return
 	}
-	mod := stat.ModTime().UTC().Format(http.TimeFormat)
-	etag := fmt.Sprintf(`W/"%d-%d"`, stat.Size(), stat.ModTime().Unix())
-	w.Header().Set("Cache-Control", "public, max-age=86400")
-	w.Header().Set("Last-Modified", mod)
-	w.Header().Set("ETag", etag)
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	events.emit(galleryEvent{Type: "deleted", ID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	if match := r.Header.Get("If-None-Match"); match != "" {
-		if strings.Contains(match, etag) {
-			w.WriteHeader(http.StatusNotModified)
+func patchImageHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	// pointers distinguish omitted fields from explicit empty strings
+	var body struct {
+		Title       *string   `json:"title"`
+		Description *string   `json:"description"`
+		Album       *string   `json:"album"`
+		Albums      *[]string `json:"albums"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	sets := []string{}
+	args := []interface{}{}
+	if body.Title != nil {
+		sets = append(sets, "title = ?")
+		args = append(args, *body.Title)
+	}
+	if body.Description != nil {
+		if utf8.RuneCountInString(*body.Description) > maxDescription {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("description exceeds %d characters", maxDescription))
 			return
 		}
+		sets = append(sets, "description = ?")
+		args = append(args, *body.Description)
 	}
-	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
-		if t, err := time.Parse(http.TimeFormat, ims); err == nil {
-			if stat.ModTime().Before(t.Add(1 * time.Second)) {
-				w.WriteHeader(http.StatusNotModified)
-				return
-			}
+	if body.Album != nil {
+		sets = append(sets, "album = ?")
+		args = append(args, normalizeAlbum(*body.Album))
+	}
+
+	if len(sets) > 0 || body.Albums != nil {
+		sets = append(sets, "updated_at = ?")
+		args = append(args, time.Now().Unix(), id)
+		res, err := db.Exec("UPDATE images SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
+	}
+	if body.Albums != nil {
+		albums := normalizeAlbums(*body.Albums)
+		// an album given alongside stays the primary one
+		if body.Album != nil {
+			albums = normalizeAlbums(append([]string{*body.Album}, albums...))
+		}
+		if err := setImageAlbums(id, albums); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "db error")
+			return
 		}
 	}
 
-	http.ServeFile(w, r, path)
+	img, err := getImage(id)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	img.Tags, _ = imageTags(img.ID)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(img)
 }
 
-func apiImagesHandler(w http.ResponseWriter, r *http.Request) {
+// apiRandomHandler returns a random image, optionally limited to ?album.
+// With ?n it returns an array of up to n distinct images instead.
+func apiRandomHandler(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
-	page := atoiDefault(q.Get("page"), 1)
-	per := atoiDefault(q.Get("per"), defaultPer)
-	album := q.Get("album")
-	offset := (page - 1) * per
+	n := 1
+	if q.Has("n") {
+		n = clampPer(atoiDefault(q.Get("n"), 1))
+	}
+	where, args := filterFromQuery(q).where()
+	rows, err := db.Query("SELECT "+imageColumns+" FROM images"+where+" ORDER BY RANDOM() LIMIT ?", append(args, n)...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	defer rows.Close()
+	images := []ImageRow{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			continue
+		}
+		images = append(images, img)
+	}
+	if len(images) == 0 {
+		writeJSONError(w, http.StatusNotFound, "no images")
+		return
+	}
+	if err := attachTags(images); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
 
-	var rows *sql.Rows
-	var err error
-	if album == "" {
-		rows, err = db.Query("SELECT id, filename, title, album, created_at FROM images ORDER BY created_at DESC LIMIT ? OFFSET ?", per, offset)
-	} else {
-		rows, err = db.Query("SELECT id, filename, title, album, created_at FROM images WHERE album = ? ORDER BY created_at DESC LIMIT ? OFFSET ?", album, per, offset)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if q.Has("n") {
+		_ = json.NewEncoder(w).Encode(images)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(images[0])
+}
+
+// apiLatestHandler returns the n newest images across all albums as a
+// plain array, without the counting a paginated listing does.
+func apiLatestHandler(w http.ResponseWriter, r *http.Request) {
+	n := atoiDefault(r.URL.Query().Get("n"), defaultLatest)
+	if n < 1 {
+		n = defaultLatest
+	}
+	if n > maxLatest {
+		n = maxLatest
 	}
+	rows, err := db.Query("SELECT "+imageColumns+" FROM images WHERE deleted_at IS NULL ORDER BY created_at DESC, id DESC LIMIT ?", n)
 	if err != nil {
-		http.Error(w, "db err", 500)
+		writeJSONError(w, http.StatusInternalServerError, "db error")
 		return
 	}
 	defer rows.Close()
 	images := []ImageRow{}
 	for rows.Next() {
-		var id, filename, title, alb string
-		var createdAt int64
-		if err := rows.Scan(&id, &filename, &title, &alb, &createdAt); err != nil {
+		img, err := scanImage(rows)
+		if err != nil {
 			continue
 		}
-		images = append(images, ImageRow{
-			ID:        id,
-			Filename:  filename,
-			Title:     title,
-			Album:     alb,
-			CreatedAt: time.Unix(createdAt, 0),
-		})
+		images = append(images, img)
+	}
+	rows.Close()
+	if err := attachTags(images); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	_ = json.NewEncoder(w).Encode(images)
+}
+
+// toggleFavoriteHandler flips the favorite flag of an image and returns
+// the new state.
+func toggleFavoriteHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var fav bool
+	err := db.QueryRow("UPDATE images SET is_favorite = 1 - is_favorite, updated_at = ? WHERE id = ? AND deleted_at IS NULL RETURNING is_favorite", time.Now().Unix(), id).Scan(&fav)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "is_favorite": fav})
+}
+
+// moveImagesHandler reassigns a batch of images to one album in a single
+// UPDATE and reports how many rows changed. Trashed images are left alone.
+func moveImagesHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		IDs   []string `json:"ids"`
+		Album string   `json:"album"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if len(body.IDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "ids must not be empty")
+		return
+	}
+
+	args := []interface{}{normalizeAlbum(body.Album), time.Now().Unix()}
+	for _, id := range body.IDs {
+		args = append(args, id)
+	}
+	res, err := db.Exec("UPDATE images SET album = ?, updated_at = ? WHERE id IN ("+placeholders(len(body.IDs))+") AND deleted_at IS NULL", args...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	n, _ := res.RowsAffected()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"moved": n})
+}
+
+// getImage loads a single row by id; it returns sql.ErrNoRows when missing.
+func getImage(id string) (ImageRow, error) {
+	return scanImage(db.QueryRow("SELECT "+imageColumns+" FROM images WHERE id = ?", id))
+}
+
+// findByChecksum returns the row holding content with the given SHA-256.
+func findByChecksum(sum string) (ImageRow, error) {
+	return scanImage(db.QueryRow("SELECT "+imageColumns+" FROM images WHERE checksum = ?", sum))
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanImage reads one row selected with imageColumns.
+func scanImage(sc rowScanner) (ImageRow, error) {
+	var img ImageRow
+	var createdAt, updatedAt, takenAt int64
+	var deletedAt sql.NullInt64
+	var lat, lng sql.NullFloat64
+	var lastViewed sql.NullInt64
+	var albums string
+	err := sc.Scan(&img.ID, &img.Filename, &img.Title, &img.Album, &createdAt, &img.Width, &img.Height, &updatedAt, &img.Checksum, &img.BlurHash, &img.DominantColor, &img.SizeBytes, &deletedAt, &img.IsFavorite, &takenAt, &img.Format, &img.Description, &img.Slug, &img.OriginalName, &img.Position, &lat, &lng, &img.ViewCount, &lastViewed, &albums)
+	if err != nil {
+		return img, err
+	}
+	img.CreatedAt = time.Unix(createdAt, 0)
+	img.UpdatedAt = time.Unix(updatedAt, 0)
+	img.TakenAt = time.Unix(takenAt, 0)
+	if deletedAt.Valid {
+		t := time.Unix(deletedAt.Int64, 0)
+		img.DeletedAt = &t
+	}
+	// positions recorded before -strip-exif was turned on stay hidden
+	if lat.Valid && lng.Valid && !stripExif {
+		img.Lat, img.Lng = &lat.Float64, &lng.Float64
+	}
+	if lastViewed.Valid {
+		t := time.Unix(lastViewed.Int64, 0)
+		img.LastViewedAt = &t
+	}
+	img.Albums = []string{}
+	if albums != "" {
+		img.Albums = strings.Split(albums, "\x1f")
+		sort.Strings(img.Albums)
+	}
+	img.Thumbnails = thumbnailRefs(img.Filename)
+	return img, nil
+}
+
+// removeThumbs deletes every cached thumbnail generated from filename.
+// Names of size-capped thumbnails depend on the original, so call it
+// before the original is removed, or collect thumbVariants before it is
+// overwritten and pass them to removeThumbNames.
+func removeThumbs(filename string) {
+	removeThumbNames(thumbVariants(filename))
+}
+
+func removeThumbNames(names []string) {
+	for _, name := range names {
+		if err := thumbStore.Delete(name); err != nil && !os.IsNotExist(err) {
+			log.Println("remove thumb error:", err)
+		}
 	}
-	type resp struct {
-		Page   int        `json:"page"`
-		Per    int        `json:"per"`
-		Images []ImageRow `json:"images"`
+}
+
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	img, err := getImage(mux.Vars(r)["id"])
+	if err == sql.ErrNoRows {
+		renderError(w, r, http.StatusNotFound, "image not found")
+		return
+	}
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if _, err := imageStore.Stat(img.Filename); err != nil {
+		renderError(w, r, http.StatusNotFound, "image not found")
+		return
+	}
+	store, name, err := servedOriginal(r.Context(), img.Filename)
+	if err != nil {
+		log.Println("watermark error:", err)
+		renderError(w, r, http.StatusInternalServerError, "image processing failed")
+		return
+	}
+	stat, err := store.Stat(name)
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, "image not found")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": friendlyName(img)}))
+	// Range and conditional requests make downloads resumable
+	serveStored(w, r, store, name, stat)
+}
+
+// healthHandler only pings the database so probes stay cheap.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	status, code := "ok", http.StatusOK
+	if err := db.PingContext(ctx); err != nil {
+		log.Println("health check:", err)
+		status, code = "degraded", http.StatusServiceUnavailable
 	}
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(resp{Page: page, Per: per, Images: images})
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// friendlyName derives a download filename from the original upload name,
+// or else the image title, keeping the stored extension. Images with
+// neither fall back to the stored name.
+func friendlyName(img ImageRow) string {
+	ext := filepath.Ext(img.Filename)
+	if img.OriginalName != "" {
+		stem := strings.TrimSuffix(img.OriginalName, filepath.Ext(img.OriginalName))
+		if strings.EqualFold(filepath.Ext(img.OriginalName), ext) || stem == "" {
+			return img.OriginalName
+		}
+		return stem + ext
+	}
+	name := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(img.Title))
+	if name == "" {
+		return img.Filename
+	}
+	return name + ext
+}
+
+// maxOriginalName caps stored client filenames.
+const maxOriginalName = 255
+
+// sanitizeFilename reduces a client-supplied filename to its last path
+// component without control characters, capped at maxOriginalName runes.
+func sanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." {
+		return ""
+	}
+	if r := []rune(name); len(r) > maxOriginalName {
+		name = string(r[:maxOriginalName])
+	}
+	return name
+}
+
+// writeJSONError sends {"error": msg} with the given status code.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// wantsJSON reports whether the request came from script (XHR/fetch)
+// rather than a plain browser form submission.
+func wantsJSON(r *http.Request) bool {
+	return r.Header.Get("X-Requested-With") == "XMLHttpRequest" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// clampPer caps a requested page size at maxPer so a crafted query string
+// can't pull the whole table into memory.
+func clampPer(n int) int {
+	if maxPer > 0 && n > maxPer {
+		return maxPer
+	}
+	return n
 }
 
 func atoiDefault(s string, d int) int {
@@ -328,4 +1218,3 @@ func atoiDefault(s string, d int) int {
 	}
 	return i
 }
-
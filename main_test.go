@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// insertTestImage adds a bare image row filed under album.
+func insertTestImage(t *testing.T, id, album string) {
+	t.Helper()
+	_, err := db.Exec("INSERT INTO images(id, filename, title, album, created_at, updated_at) VALUES (?, ?, ?, ?, 100, 100)",
+		id, id+".jpg", "title "+id, album)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `W/"3-7-abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`W/"3-7-abc"`, true},
+		{`"3-7-abc"`, true},
+		{`*`, true},
+		{`W/"1-1-aaa", W/"3-7-abc"`, true},
+		{`W/"3-7-ab"`, false},
+		{`W/"13-7-abc"`, false},
+		{`W/"3-7-abcd"`, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set("If-None-Match", tt.header)
+		}
+		if got := etagMatches(r, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	const etag = `W/"1-2-3"`
+	mod := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	tests := []struct {
+		name     string
+		inm, ims string
+		want304  bool
+	}{
+		{name: "no validators"},
+		{name: "matching etag", inm: etag, want304: true},
+		{name: "other etag", inm: `W/"9-9-9"`},
+		{name: "not modified since", ims: mod.Format(http.TimeFormat), want304: true},
+		{name: "modified since", ims: mod.Add(-time.Hour).Format(http.TimeFormat)},
+		{name: "unparsable date", ims: "yesterday"},
+		// If-None-Match wins over If-Modified-Since
+		{name: "etag mismatch beats date", inm: `W/"9-9-9"`, ims: mod.Add(time.Hour).Format(http.TimeFormat)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.inm != "" {
+				r.Header.Set("If-None-Match", tt.inm)
+			}
+			if tt.ims != "" {
+				r.Header.Set("If-Modified-Since", tt.ims)
+			}
+			w := httptest.NewRecorder()
+			got := notModified(w, r, etag, mod)
+			if got != tt.want304 {
+				t.Fatalf("notModified = %v, want %v", got, tt.want304)
+			}
+			if tt.want304 && w.Code != http.StatusNotModified {
+				t.Errorf("status = %d, want 304", w.Code)
+			}
+			if w.Header().Get("ETag") != etag || w.Header().Get("Last-Modified") == "" {
+				t.Errorf("validators not set: %v", w.Header())
+			}
+		})
+	}
+}
+
+func TestListingValidators(t *testing.T) {
+	openTestDB(t)
+	insertTestImage(t, "a", "trip")
+	insertTestImage(t, "b", "home")
+
+	all := imageFilter{}
+	trip := imageFilter{Albums: []string{"trip"}}
+	etag := func(f imageFilter, query string) string {
+		t.Helper()
+		tag, _, err := listingValidators(f, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tag
+	}
+
+	if etag(all, "") != etag(all, "") {
+		t.Fatal("etag not stable without changes")
+	}
+	if etag(all, "page=1") == etag(all, "page=2") {
+		t.Error("pages share an etag")
+	}
+
+	// every kind of write must change the tag, even within one second
+	writes := []struct {
+		name string
+		stmt string
+	}{
+		{"title edit", "UPDATE images SET title = 'new' WHERE id = 'a'"},
+		{"second title edit", "UPDATE images SET title = 'newer' WHERE id = 'a'"},
+		{"extra album", "INSERT INTO image_albums(image_id, album) VALUES ('b', 'trip')"},
+		{"album rename of a membership", "UPDATE image_albums SET album = 'trips' WHERE image_id = 'b' AND album = 'trip'"},
+		{"detach", "DELETE FROM image_albums WHERE image_id = 'b' AND album = 'trips'"},
+		{"tag", "INSERT INTO image_tags(image_id, tag_id) VALUES ('a', 1)"},
+		{"favorite", "UPDATE images SET is_favorite = 1 WHERE id = 'a'"},
+		{"trash", "UPDATE images SET deleted_at = 100 WHERE id = 'b'"},
+		{"delete", "DELETE FROM images WHERE id = 'b'"},
+	}
+	for _, w := range writes {
+		before := etag(trip, "")
+		if _, err := db.Exec(w.stmt); err != nil {
+			t.Fatalf("%s: %v", w.name, err)
+		}
+		if etag(trip, "") == before {
+			t.Errorf("%s left the etag unchanged", w.name)
+		}
+	}
+
+	// views are flushed too often to invalidate listings
+	before := etag(trip, "")
+	if err := flushViews(map[string]int{"a": 2}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if etag(trip, "") != before {
+		t.Error("recording views changed the etag")
+	}
+}
+
+func TestAPIImagesConditional(t *testing.T) {
+	openTestDB(t)
+	insertTestImage(t, "a", "trip")
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/images?"+url.Values{"album": {"trip"}}.Encode(), nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		apiImagesHandler(w, r)
+		return w
+	}
+
+	first := get("", "")
+	if first.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", first.Code)
+	}
+	etag := first.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if w := get("If-None-Match", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("revalidation: status %d, %d body bytes; want empty 304", w.Code, w.Body.Len())
+	}
+	// listings only trust the ETag: a deletion does not move Last-Modified
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if w := get("If-Modified-Since", future); w.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since alone: status %d, want 200", w.Code)
+	}
+
+	if _, err := db.Exec("DELETE FROM images WHERE id = 'a'"); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("If-None-Match", etag); w.Code != http.StatusOK {
+		t.Errorf("after a deletion: status %d, want 200", w.Code)
+	}
+}
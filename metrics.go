@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus collectors. They are always updated but only registered and
+// exposed at /metrics when metricsEnabled is set.
+var (
+	uploadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gallery_uploads_total",
+		Help: "Uploaded files by result (created, duplicate, failed).",
+	}, []string{"result"})
+
+	thumbRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gallery_thumb_requests_total",
+		Help: "Thumbnail requests by cache result (hit, generated).",
+	}, []string{"cache"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gallery_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+)
+
+// metricsHandler registers the collectors and returns the /metrics handler.
+func metricsHandler() http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		uploadsTotal,
+		thumbRequestsTotal,
+		requestDuration,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
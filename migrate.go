@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one numbered schema change. Versions are applied in order,
+// each in its own transaction, and recorded in schema_migrations so they
+// run exactly once per database. Never edit or renumber a released
+// migration; append a new one instead.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations is the full schema history. Databases created before
+// versioning already have some of these columns, which is why column
+// additions go through addColumn and tolerate existing columns.
+var migrations = []migration{
+	{1, "create images", execSQL(`
+	CREATE TABLE IF NOT EXISTS images (
+	  id TEXT PRIMARY KEY,
+	  filename TEXT NOT NULL,
+	  title TEXT,
+	  album TEXT,
+	  created_at INTEGER NOT NULL
+	)`)},
+	{2, "add image dimensions", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "images", "width", "INTEGER"); err != nil {
+			return err
+		}
+		return addColumn(tx, "images", "height", "INTEGER")
+	}},
+	{3, "add updated_at", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "images", "updated_at", "INTEGER"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE images SET updated_at = created_at WHERE updated_at IS NULL")
+		return err
+	}},
+	{4, "add checksum", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "images", "checksum", "TEXT"); err != nil {
+			return err
+		}
+		// rows from before checksums were recorded stay NULL, which SQLite
+		// does not count as a duplicate
+		_, err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_images_checksum ON images(checksum)")
+		return err
+	}},
+	{5, "add blurhash", addColumnMigration("images", "blurhash", "TEXT")},
+	{6, "add size_bytes", addColumnMigration("images", "size_bytes", "INTEGER")},
+	{7, "add deleted_at", addColumnMigration("images", "deleted_at", "INTEGER")},
+	{8, "add dominant_color", addColumnMigration("images", "dominant_color", "TEXT")},
+	{9, "add is_favorite", addColumnMigration("images", "is_favorite", "INTEGER NOT NULL DEFAULT 0")},
+	{10, "add taken_at", addColumnMigration("images", "taken_at", "INTEGER")},
+	{11, "add format", addColumnMigration("images", "format", "TEXT")},
+	{12, "add description", addColumnMigration("images", "description", "TEXT")},
+	{13, "add slug", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "images", "slug", "TEXT"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_images_slug ON images(slug)")
+		return err
+	}},
+	{14, "add original_name", addColumnMigration("images", "original_name", "TEXT")},
+	{15, "add position", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "images", "position", "INTEGER"); err != nil {
+			return err
+		}
+		// existing rows keep their upload order within each album
+		_, err := tx.Exec(`UPDATE images SET position = (
+			SELECT n FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY album ORDER BY created_at, id) AS n FROM images) o
+			WHERE o.id = images.id) WHERE position IS NULL`)
+		return err
+	}},
+	{16, "add gps position", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "images", "lat", "REAL"); err != nil {
+			return err
+		}
+		return addColumn(tx, "images", "lng", "REAL")
+	}},
+	{17, "create tag tables", execSQL(`
+	CREATE TABLE IF NOT EXISTS tags (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  name TEXT NOT NULL UNIQUE
+	);
+	CREATE TABLE IF NOT EXISTS image_tags (
+	  image_id TEXT NOT NULL,
+	  tag_id INTEGER NOT NULL,
+	  PRIMARY KEY (image_id, tag_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_image_tags_tag ON image_tags(tag_id)`)},
+	// albums stores per-album metadata. Albums themselves are still just
+	// the distinct values of images.album; a row only exists once
+	// something about the album has been customised.
+	{18, "create albums", execSQL(`
+	CREATE TABLE IF NOT EXISTS albums (
+	  name TEXT PRIMARY KEY,
+	  cover_image_id TEXT
+	)`)},
+	{19, "add view tracking", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "images", "view_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumn(tx, "images", "last_viewed_at", "INTEGER")
+	}},
+	// image_albums files an image under any number of albums. images.album
+	// stays the primary album, and the triggers keep it a member however
+	// it is written, so only extra albums are managed by hand.
+	{20, "create image_albums", execSQL(`
+	CREATE TABLE IF NOT EXISTS image_albums (
+	  image_id TEXT NOT NULL,
+	  album TEXT NOT NULL,
+	  PRIMARY KEY (image_id, album)
+	);
+	CREATE INDEX IF NOT EXISTS idx_image_albums_album ON image_albums(album);
+	INSERT OR IGNORE INTO image_albums(image_id, album)
+	  SELECT id, album FROM images WHERE COALESCE(album, '') != '';
+	CREATE TRIGGER IF NOT EXISTS images_album_insert AFTER INSERT ON images
+	WHEN COALESCE(NEW.album, '') != '' BEGIN
+	  INSERT OR IGNORE INTO image_albums(image_id, album) VALUES (NEW.id, NEW.album);
+	END;
+	CREATE TRIGGER IF NOT EXISTS images_album_update AFTER UPDATE OF album ON images
+	WHEN COALESCE(NEW.album, '') != COALESCE(OLD.album, '') BEGIN
+	  DELETE FROM image_albums WHERE image_id = OLD.id AND album = COALESCE(OLD.album, '');
+	  INSERT OR IGNORE INTO image_albums(image_id, album)
+	    SELECT NEW.id, NEW.album WHERE COALESCE(NEW.album, '') != '';
+	END;
+	CREATE TRIGGER IF NOT EXISTS images_album_delete AFTER DELETE ON images BEGIN
+	  DELETE FROM image_albums WHERE image_id = OLD.id;
+	END`)},
+	// gallery_version counts writes to the tables listings are built
+	// from, so listing ETags change with every edit, however it is made
+	// and however many land in the same second.
+	{21, "create gallery_version", execSQL(`
+	CREATE TABLE IF NOT EXISTS gallery_version (
+	  id INTEGER PRIMARY KEY CHECK (id = 1),
+	  version INTEGER NOT NULL
+	);
+	INSERT OR IGNORE INTO gallery_version(id, version) VALUES (1, 0);
+	CREATE TRIGGER IF NOT EXISTS images_version_insert AFTER INSERT ON images BEGIN
+	  UPDATE gallery_version SET version = version + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS images_version_update AFTER UPDATE ON images BEGIN
+	  UPDATE gallery_version SET version = version + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS images_version_delete AFTER DELETE ON images BEGIN
+	  UPDATE gallery_version SET version = version + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS image_albums_version_insert AFTER INSERT ON image_albums BEGIN
+	  UPDATE gallery_version SET version = version + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS image_albums_version_update AFTER UPDATE ON image_albums BEGIN
+	  UPDATE gallery_version SET version = version + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS image_albums_version_delete AFTER DELETE ON image_albums BEGIN
+	  UPDATE gallery_version SET version = version + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS image_tags_version_insert AFTER INSERT ON image_tags BEGIN
+	  UPDATE gallery_version SET version = version + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS image_tags_version_update AFTER UPDATE ON image_tags BEGIN
+	  UPDATE gallery_version SET version = version + 1;
+	END;
+	CREATE TRIGGER IF NOT EXISTS image_tags_version_delete AFTER DELETE ON image_tags BEGIN
+	  UPDATE gallery_version SET version = version + 1;
+	END`)},
+	// positions move onto memberships so each album has its own manual
+	// order. Primary albums keep theirs and extra members follow; new
+	// members go to the end. images.position stays the order of the
+	// uncategorized album, which has no membership rows.
+	{22, "add album positions", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "image_albums", "position", "INTEGER"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE image_albums SET position = (
+			SELECT n FROM (SELECT ia.image_id, ia.album, ROW_NUMBER() OVER (
+			    PARTITION BY ia.album ORDER BY i.album IS NOT ia.album, COALESCE(i.position, 0), i.created_at, i.id) AS n
+			  FROM image_albums ia JOIN images i ON i.id = ia.image_id) o
+			WHERE o.image_id = image_albums.image_id AND o.album = image_albums.album) WHERE position IS NULL;
+		CREATE TRIGGER IF NOT EXISTS image_albums_position AFTER INSERT ON image_albums
+		WHEN NEW.position IS NULL BEGIN
+		  UPDATE image_albums SET position = (SELECT COALESCE(MAX(position), 0) + 1 FROM image_albums WHERE album = NEW.album)
+		  WHERE image_id = NEW.image_id AND album = NEW.album;
+		END`)
+		return err
+	}},
+	// view counts are flushed every few seconds and are not worth
+	// invalidating every listing for, so writes that only record views
+	// leave gallery_version alone
+	{23, "skip views in gallery_version", execSQL(`
+	DROP TRIGGER IF EXISTS images_version_update;
+	CREATE TRIGGER images_version_update AFTER UPDATE ON images
+	WHEN OLD.view_count IS NEW.view_count AND OLD.last_viewed_at IS NEW.last_viewed_at BEGIN
+	  UPDATE gallery_version SET version = version + 1;
+	END`)},
+}
+
+// migrate brings the schema up to the latest version.
+func migrate() error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	  version INTEGER PRIMARY KEY,
+	  name TEXT NOT NULL,
+	  applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+	applied := map[int]bool{}
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if err := applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Printf("applied migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+func applyMigration(m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations(version, name, applied_at) VALUES(?, ?, ?)", m.version, m.name, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// execSQL is a migration that runs fixed statements.
+func execSQL(stmt string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(stmt)
+		return err
+	}
+}
+
+// addColumnMigration is a migration that adds a single column.
+func addColumnMigration(table, column, def string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		return addColumn(tx, table, column, def)
+	}
+}
+
+// addColumn adds a column to an existing table unless it is already there.
+func addColumn(tx *sql.Tx, table, column, def string) error {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	exists := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == column {
+			exists = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || exists {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + def)
+	return err
+}
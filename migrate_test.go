@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB points db at a fresh database in a temp dir, migrated to the
+// latest version, and closes it when the test ends.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	useTestDB(t)
+	if err := migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+}
+
+// useTestDB points db at an empty database without migrating it.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	var err error
+	db, err = sql.Open("sqlite", filepath.Join(t.TempDir(), "gallery.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+}
+
+func appliedVersions(t *testing.T) []int {
+	t.Helper()
+	rows, err := db.Query("SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func columnExists(t *testing.T, table, column string) bool {
+	t.Helper()
+	var n int
+	err := db.QueryRow("SELECT COUNT(1) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d (%s) has version %d", i+1, m.name, m.version)
+		}
+		if m.name == "" || m.up == nil {
+			t.Errorf("migration %d is incomplete", m.version)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup string // schema the database starts with
+	}{
+		{"fresh database", ""},
+		// databases from before versioning already have some columns
+		{"pre-versioning database", `CREATE TABLE images (
+		  id TEXT PRIMARY KEY,
+		  filename TEXT NOT NULL,
+		  title TEXT,
+		  album TEXT,
+		  created_at INTEGER NOT NULL,
+		  width INTEGER,
+		  height INTEGER,
+		  checksum TEXT
+		);
+		INSERT INTO images(id, filename, album, created_at) VALUES ('a', 'a.jpg', 'trip', 1)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDB(t)
+			if tt.setup != "" {
+				if _, err := db.Exec(tt.setup); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := migrate(); err != nil {
+				t.Fatalf("migrate: %v", err)
+			}
+			if got := appliedVersions(t); len(got) != len(migrations) {
+				t.Fatalf("applied %v, want %d migrations", got, len(migrations))
+			}
+			for _, col := range []string{"width", "updated_at", "checksum", "deleted_at", "lat", "view_count"} {
+				if !columnExists(t, "images", col) {
+					t.Errorf("images.%s missing", col)
+				}
+			}
+			if !columnExists(t, "image_albums", "position") {
+				t.Error("image_albums.position missing")
+			}
+			// a second run applies nothing and succeeds
+			if err := migrate(); err != nil {
+				t.Fatalf("second migrate: %v", err)
+			}
+			if got := appliedVersions(t); len(got) != len(migrations) {
+				t.Errorf("second run applied %v", got)
+			}
+		})
+	}
+}
+
+func TestMigrateExistingRows(t *testing.T) {
+	useTestDB(t)
+	if _, err := db.Exec(`CREATE TABLE images (id TEXT PRIMARY KEY, filename TEXT NOT NULL, title TEXT, album TEXT, created_at INTEGER NOT NULL);
+		INSERT INTO images(id, filename, album, created_at) VALUES ('a', 'a.jpg', 'trip', 7)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	var updated int64
+	var album string
+	if err := db.QueryRow("SELECT updated_at, (SELECT album FROM image_albums WHERE image_id = 'a') FROM images WHERE id = 'a'").Scan(&updated, &album); err != nil {
+		t.Fatal(err)
+	}
+	if updated != 7 {
+		t.Errorf("updated_at = %d, want created_at 7", updated)
+	}
+	if album != "trip" {
+		t.Errorf("image_albums seeded with %q, want trip", album)
+	}
+}
+
+func TestMigrateFailureRollsBack(t *testing.T) {
+	openTestDB(t)
+	saved := migrations
+	defer func() { migrations = saved }()
+	next := len(saved) + 1
+	migrations = append(append([]migration{}, saved...), migration{next, "broken", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("CREATE TABLE half_done (id INTEGER)"); err != nil {
+			return err
+		}
+		return errors.New("boom")
+	}})
+
+	if err := migrate(); err == nil {
+		t.Fatal("migrate succeeded with a failing migration")
+	}
+	if got := appliedVersions(t); len(got) != len(saved) {
+		t.Errorf("applied %v after failure, want %d migrations", got, len(saved))
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(1) FROM sqlite_master WHERE name = 'half_done'").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Error("failed migration was not rolled back")
+	}
+}
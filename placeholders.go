@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Placeholders are the cheap stand-ins shown while an image loads: its
+// BlurHash and its average color. Both come from one decode of the original.
+
+// updatePlaceholders computes and stores the placeholders of one image.
+func updatePlaceholders(id, filename string) error {
+	f, err := imageStore.Open(filename)
+	if err != nil {
+		return err
+	}
+	img, err := decodeImage(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE images SET blurhash = ?, dominant_color = ?, updated_at = ? WHERE id = ?", blurHashOf(img), dominantColor(img), time.Now().Unix(), id)
+	return err
+}
+
+// dominantColor returns the average color of img as "#rrggbb". Resizing
+// to a single pixel with a box filter averages every pixel.
+func dominantColor(img image.Image) string {
+	px := imaging.Resize(img, 1, 1, imaging.Box)
+	c := color.NRGBAModel.Convert(px.At(0, 0)).(color.NRGBA)
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// backfillPlaceholders computes placeholders for rows uploaded before they
+// were recorded. Failures are logged and skipped.
+func backfillPlaceholders() error {
+	rows, err := db.Query("SELECT id, filename FROM images WHERE COALESCE(blurhash, '') = '' OR COALESCE(dominant_color, '') = ''")
+	if err != nil {
+		return err
+	}
+	type pending struct{ id, filename string }
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.filename); err != nil {
+			rows.Close()
+			return err
+		}
+		todo = append(todo, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	done := 0
+	for _, p := range todo {
+		if err := updatePlaceholders(p.id, p.filename); err != nil {
+			log.Printf("placeholders %s: %v", p.filename, err)
+			continue
+		}
+		done++
+	}
+	log.Printf("placeholder backfill: %d of %d images updated", done, len(todo))
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+)
+
+// errQuotaExceeded rejects an upload that would take the gallery past
+// maxBytes.
+var errQuotaExceeded = &uploadFailure{http.StatusInsufficientStorage, "storage quota exceeded"}
+
+// quota tracks bytes of uploads that are being stored but not yet counted
+// in the images table, so concurrent uploads cannot overshoot maxBytes
+// together.
+var quota struct {
+	sync.Mutex
+	inFlight int64
+}
+
+// reserveBytes claims n bytes of the storage quota for an upload. The
+// returned release must be called once the row is written or the upload
+// abandoned. With no quota configured it always succeeds.
+func reserveBytes(n int64) (release func(), err error) {
+	if maxBytes <= 0 {
+		return func() {}, nil
+	}
+	quota.Lock()
+	defer quota.Unlock()
+	var used int64
+	if err := db.QueryRow("SELECT COALESCE(SUM(size_bytes), 0) FROM images").Scan(&used); err != nil {
+		return nil, err
+	}
+	if used+quota.inFlight+n > maxBytes {
+		log.Printf("storage quota hit: %d bytes used, %d in flight, %d requested, limit %d", used, quota.inFlight, n, maxBytes)
+		return nil, errQuotaExceeded
+	}
+	quota.inFlight += n
+	return func() {
+		quota.Lock()
+		quota.inFlight -= n
+		quota.Unlock()
+	}, nil
+}
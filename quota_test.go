@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReserveBytes(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec("INSERT INTO images(id, filename, created_at, size_bytes) VALUES ('a', 'a.jpg', 1, 40)"); err != nil {
+		t.Fatal(err)
+	}
+	defer func(v int64) { maxBytes = v }(maxBytes)
+
+	maxBytes = 0
+	release, err := reserveBytes(1 << 40)
+	if err != nil {
+		t.Fatalf("no quota: %v", err)
+	}
+	release()
+
+	maxBytes = 100
+	steps := []struct {
+		n       int64
+		wantErr bool
+	}{
+		{50, false}, // 40 stored + 50 in flight
+		{20, true},  // would reach 110
+		{10, false}, // exactly 100
+		{1, true},
+	}
+	var releases []func()
+	for _, s := range steps {
+		release, err := reserveBytes(s.n)
+		if (err != nil) != s.wantErr {
+			t.Fatalf("reserve %d: err = %v, want error %v", s.n, err, s.wantErr)
+		}
+		if err == nil {
+			releases = append(releases, release)
+		} else if err != errQuotaExceeded {
+			t.Fatalf("reserve %d: err = %v, want errQuotaExceeded", s.n, err)
+		}
+	}
+	for _, release := range releases {
+		release()
+	}
+	release, err = reserveBytes(60)
+	if err != nil {
+		t.Fatalf("released bytes not returned: %v", err)
+	}
+	release()
+}
+
+func TestReserveBytesConcurrent(t *testing.T) {
+	openTestDB(t)
+	defer func(v int64) { maxBytes = v }(maxBytes)
+	maxBytes = 60
+
+	var granted atomic.Int64
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var releases []func()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if release, err := reserveBytes(10); err == nil {
+				granted.Add(1)
+				mu.Lock()
+				releases = append(releases, release)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if granted.Load() != 6 {
+		t.Errorf("%d of 10 concurrent reservations granted, want 6", granted.Load())
+	}
+	for _, release := range releases {
+		release()
+	}
+}
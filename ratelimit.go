@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// withUploadLimit applies the per-IP upload rate limit, if one is configured.
+func withUploadLimit(h http.Handler) http.Handler {
+	if uploadsPerMinute <= 0 {
+		return h
+	}
+	return newIPLimiter(uploadsPerMinute).middleware(h)
+}
+
+// ipLimiter hands out one token bucket per client IP.
+type ipLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+	limit    rate.Limit
+	burst    int
+}
+
+type limiterEntry struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+// newIPLimiter allows perMinute requests per IP, with bursts of the same size.
+func newIPLimiter(perMinute int) *ipLimiter {
+	l := &ipLimiter{
+		limiters: map[string]*limiterEntry{},
+		limit:    rate.Limit(float64(perMinute) / 60),
+		burst:    perMinute,
+	}
+	go l.evictLoop()
+	return l
+}
+
+func (l *ipLimiter) get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.limiters[ip]
+	if !ok {
+		e = &limiterEntry{lim: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = e
+	}
+	e.lastSeen = time.Now()
+	return e.lim
+}
+
+// evictLoop forgets clients idle long enough for their bucket to be full
+// again, so the map doesn't grow with every address ever seen.
+func (l *ipLimiter) evictLoop() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for ip, e := range l.limiters {
+			if time.Since(e.lastSeen) > 3*time.Minute {
+				delete(l.limiters, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// middleware answers 429 with Retry-After once a client runs out of tokens.
+func (l *ipLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := l.get(clientIP(r)).Reserve()
+		if delay := res.Delay(); delay > 0 {
+			res.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			uploadError(w, r, http.StatusTooManyRequests, "too many uploads, slow down")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client. Behind a proxy (trustProxy)
+// it comes from X-Forwarded-For, read from the right, where the proxies
+// append: private addresses are proxy hops and are skipped, and the first
+// public one is the client. Entries left of it were sent by the client and
+// are never used, so they can't be rotated to dodge the rate limit. With
+// only private hops the last one counts, and without the header X-Real-IP.
+// Without trustProxy both headers are ignored, since anyone can send them.
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		var hops []netip.Addr
+		for _, part := range strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",") {
+			if ip, err := netip.ParseAddr(strings.TrimSpace(part)); err == nil {
+				hops = append(hops, ip)
+			}
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			if publicAddress(hops[i]) {
+				return hops[i].Unmap().String()
+			}
+		}
+		// a client on the proxy's own network
+		if len(hops) > 0 {
+			return hops[len(hops)-1].Unmap().String()
+		}
+		if ip, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return ip.Unmap().String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(v bool) { trustProxy = v }(trustProxy)
+	tests := []struct {
+		name  string
+		trust bool
+		xff   []string
+		real  string
+		want  string
+	}{
+		{name: "no proxy ignores headers", xff: []string{"93.184.216.34"}, real: "8.8.8.8", want: "192.0.2.1"},
+		{name: "single hop", trust: true, xff: []string{"93.184.216.34"}, want: "93.184.216.34"},
+		{name: "forged entries left of the client", trust: true, xff: []string{"1.2.3.4, 5.6.7.8, 93.184.216.34"}, want: "93.184.216.34"},
+		{name: "private proxy hops skipped", trust: true, xff: []string{"1.2.3.4, 93.184.216.34, 10.0.0.2, 172.16.0.3"}, want: "93.184.216.34"},
+		{name: "proxies appending header lines", trust: true, xff: []string{"1.2.3.4", "93.184.216.34", "10.0.0.2"}, want: "93.184.216.34"},
+		{name: "client on the proxy network", trust: true, xff: []string{"10.9.9.9, 10.0.0.2"}, want: "10.0.0.2"},
+		{name: "junk entries", trust: true, xff: []string{"93.184.216.34, nonsense"}, want: "93.184.216.34"},
+		{name: "mapped address", trust: true, xff: []string{"::ffff:93.184.216.34"}, want: "93.184.216.34"},
+		{name: "x-real-ip fallback", trust: true, real: "93.184.216.34", want: "93.184.216.34"},
+		{name: "no headers", trust: true, want: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		trustProxy = tt.trust
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if tt.real != "" {
+			r.Header.Set("X-Real-IP", tt.real)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
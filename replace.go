@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// replaceFileHandler swaps the original of an existing image for a new
+// upload in the "image" field, keeping its id, title, album and tags.
+// Cached thumbnails are dropped and placeholders recomputed.
+func replaceFileHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	old, err := getImage(id)
+	if err == sql.ErrNoRows || (err == nil && old.DeletedAt != nil) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	limit := uploadLimit(r)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid form")
+		return
+	}
+	// stream the "image" part straight to a temp file, like uploads do;
+	// other fields are skipped
+	var st *stagedUpload
+	for st == nil {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			writeJSONError(w, http.StatusBadRequest, "image required")
+			return
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, uploadTooLarge(limit).Msg)
+			} else {
+				writeJSONError(w, http.StatusBadRequest, "invalid form")
+			}
+			return
+		}
+		if part.FormName() != "image" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		st, err = stageUpload(part)
+		part.Close()
+		if err == errUploadTooLarge {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, uploadTooLarge(limit).Msg)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, failureStatus(err), err.Error())
+			return
+		}
+		st.Name = part.FileName()
+	}
+	defer os.Remove(st.Path)
+
+	if st.Checksum != old.Checksum {
+		if other, err := findByChecksum(st.Checksum); err == nil && other.ID != id {
+			writeJSONError(w, http.StatusConflict, "identical image already exists as "+other.ID)
+			return
+		}
+	}
+	if err := st.process(); err != nil {
+		writeJSONError(w, failureStatus(err), err.Error())
+		return
+	}
+
+	release, err := reserveBytes(st.Size - old.SizeBytes)
+	if err != nil {
+		writeJSONError(w, failureStatus(err), err.Error())
+		return
+	}
+	defer release()
+
+	// the id stays; the extension follows the new content
+	oldName := filepath.Base(old.Filename)
+	filename := id + st.Ext
+	staleThumbs := thumbVariants(oldName)
+	var takenAt interface{}
+	if !st.TakenAt.IsZero() {
+		takenAt = st.TakenAt.Unix()
+	}
+	err = swapOriginal(filename, st.Path, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE images SET filename = ?, original_name = ?, width = ?, height = ?, checksum = ?, size_bytes = ?, taken_at = ?, format = ?, lat = ?, lng = ?,
+			blurhash = NULL, dominant_color = NULL, updated_at = ? WHERE id = ?`,
+			filename, sanitizeFilename(st.Name), st.Width, st.Height, st.Checksum, st.Size, takenAt, st.Format, st.Lat, st.Lng, time.Now().Unix(), id)
+		return err
+	})
+	if err != nil {
+		log.Println("replace file error:", err)
+		writeJSONError(w, http.StatusInternalServerError, "unable to save file")
+		return
+	}
+
+	if filename != oldName {
+		if err := imageStore.Delete(oldName); err != nil && !os.IsNotExist(err) {
+			log.Println("remove image error:", err)
+		}
+	}
+	removeThumbNames(staleThumbs)
+	go processUpload(id, filename)
+
+	img, err := getImage(id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	img.Tags, _ = imageTags(id)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(img)
+}
+
+// swapOriginal stores the file at path in imageStore as name and runs
+// update in the same step, so the row and the stored original never
+// disagree. The new bytes go to a temporary name first; only once update
+// succeeded are they renamed over name and the transaction committed. On
+// failure the file under name, if any, is left as it was.
+func swapOriginal(name, path string, update func(tx *sql.Tx) error) error {
+	tmp := ".swap-" + name
+	if err := storeFile(imageStore, tmp, path); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err == nil {
+		defer tx.Rollback()
+		err = update(tx)
+	}
+	if err == nil {
+		err = imageStore.Rename(tmp, name)
+	}
+	if err != nil {
+		imageStore.Delete(tmp)
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapOriginal(t *testing.T) {
+	openTestDB(t)
+	dir := t.TempDir()
+	defer func(s Storage) { imageStore = s }(imageStore)
+	imageStore = LocalStorage{Dir: dir}
+	insertTestImage(t, "a", "trip")
+	if err := os.WriteFile(filepath.Join(dir, "a.jpg"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "new.jpg")
+	if err := os.WriteFile(src, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	check := func(wantFile, wantTitle string) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, "a.jpg"))
+		if err != nil || string(data) != wantFile {
+			t.Errorf("stored file = %q, %v; want %q", data, err, wantFile)
+		}
+		var title string
+		if err := db.QueryRow("SELECT title FROM images WHERE id = 'a'").Scan(&title); err != nil || title != wantTitle {
+			t.Errorf("title = %q, %v; want %q", title, err, wantTitle)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("%d files in the store, want 1", len(entries))
+		}
+	}
+	update := func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE images SET title = 'swapped' WHERE id = 'a'")
+		return err
+	}
+
+	// a failed update leaves the old bytes and the old row
+	err := swapOriginal("a.jpg", src, func(tx *sql.Tx) error {
+		if err := update(tx); err != nil {
+			return err
+		}
+		return errors.New("boom")
+	})
+	if err == nil {
+		t.Fatal("swap succeeded with a failing update")
+	}
+	check("old", "title a")
+
+	if err := swapOriginal("a.jpg", src, update); err != nil {
+		t.Fatal(err)
+	}
+	check("new", "swapped")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// sitemapBatch is how many rows each sitemap query reads, so large
+// galleries are streamed rather than loaded at once.
+const sitemapBatch = 500
+
+// requestBase returns the scheme and host the client used to reach us,
+// for building absolute URLs. X-Forwarded-Proto is only believed with
+// trustProxy.
+func requestBase(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || (trustProxy && r.Header.Get("X-Forwarded-Proto") == "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// sitemapHandler streams an XML sitemap with one <url> per image share
+// page, listing the original and its thumbnails as image entries.
+func sitemapHandler(w http.ResponseWriter, r *http.Request) {
+	base := requestBase(r)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, xml.Header)
+	fmt.Fprintln(bw, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9" xmlns:image="http://www.google.com/schemas/sitemap-image/1.1">`)
+
+	after := ""
+	for {
+		n, last, err := writeSitemapBatch(bw, base, after)
+		if err != nil {
+			// headers are gone already; all we can do is stop early
+			log.Println("sitemap error:", err)
+			break
+		}
+		if n < sitemapBatch {
+			break
+		}
+		after = last
+	}
+
+	fmt.Fprintln(bw, `</urlset>`)
+	if err := bw.Flush(); err != nil {
+		log.Println("sitemap write error:", err)
+	}
+}
+
+// writeSitemapBatch writes the entries of up to sitemapBatch images with
+// ids after the given one, returning how many it wrote and the last id.
+func writeSitemapBatch(bw *bufio.Writer, base, after string) (int, string, error) {
+	rows, err := db.Query("SELECT id, filename, COALESCE(slug, ''), COALESCE(updated_at, created_at) FROM images WHERE deleted_at IS NULL AND id > ? ORDER BY id LIMIT ?", after, sitemapBatch)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+
+	n, last := 0, after
+	for rows.Next() {
+		var id, filename, slug string
+		var updatedAt int64
+		if err := rows.Scan(&id, &filename, &slug, &updatedAt); err != nil {
+			return n, last, err
+		}
+		n++
+		last = id
+
+		page := base + "/api/images/" + url.PathEscape(id)
+		if slug != "" {
+			page = base + "/i/" + url.PathEscape(slug)
+		}
+		fmt.Fprint(bw, "<url><loc>")
+		xml.EscapeText(bw, []byte(page))
+		fmt.Fprintf(bw, "</loc><lastmod>%s</lastmod>", time.Unix(updatedAt, 0).UTC().Format(time.RFC3339))
+		writeSitemapImage(bw, base+"/images/"+url.PathEscape(filename))
+		for _, t := range thumbnailRefs(filename) {
+			writeSitemapImage(bw, base+t.URL)
+		}
+		fmt.Fprintln(bw, "</url>")
+	}
+	return n, last, rows.Err()
+}
+
+func writeSitemapImage(bw *bufio.Writer, loc string) {
+	fmt.Fprint(bw, "<image:image><image:loc>")
+	xml.EscapeText(bw, []byte(loc))
+	fmt.Fprint(bw, "</image:loc></image:image>")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	slugAlphabet  = "abcdefghijklmnopqrstuvwxyz0123456789"
+	maxSlugPrefix = 50
+)
+
+// newSlug builds a share slug like "sunset-at-the-beach-x7k2qa" from a
+// title. The random suffix keeps slugs unique when titles repeat; titles
+// with nothing usable get a longer random slug instead.
+func newSlug(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+		if b.Len() >= maxSlugPrefix {
+			break
+		}
+	}
+	prefix := strings.Trim(b.String(), "-")
+	if prefix == "" {
+		return randomString(10)
+	}
+	return prefix + "-" + randomString(6)
+}
+
+func randomString(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	for i := range buf {
+		buf[i] = slugAlphabet[int(buf[i])%len(slugAlphabet)]
+	}
+	return string(buf)
+}
+
+// backfillSlugs gives rows from before slugs existed a slug of their own.
+func backfillSlugs() {
+	rows, err := db.Query("SELECT id, COALESCE(title, '') FROM images WHERE slug IS NULL")
+	if err != nil {
+		log.Fatalf("backfill slugs: %v", err)
+	}
+	titles := map[string]string{}
+	for rows.Next() {
+		var id, title string
+		if err := rows.Scan(&id, &title); err != nil {
+			log.Fatalf("backfill slugs: %v", err)
+		}
+		titles[id] = title
+	}
+	rows.Close()
+	for id, title := range titles {
+		if _, err := db.Exec("UPDATE images SET slug = ? WHERE id = ?", newSlug(title), id); err != nil {
+			log.Fatalf("backfill slugs: %v", err)
+		}
+	}
+}
+
+// slugHandler resolves a share link. JSON clients get the image metadata;
+// browsers are sent to the full-size image.
+func slugHandler(w http.ResponseWriter, r *http.Request) {
+	img, err := scanImage(db.QueryRow("SELECT "+imageColumns+" FROM images WHERE slug = ? AND deleted_at IS NULL", mux.Vars(r)["slug"]))
+	if err == sql.ErrNoRows {
+		renderError(w, r, http.StatusNotFound, "image not found")
+		return
+	}
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, "db error")
+		return
+	}
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/images/"+img.Filename, http.StatusFound)
+		return
+	}
+	img.Tags, _ = imageTags(img.ID)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(img)
+}
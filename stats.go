@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// statsTTL is how long /api/stats reuses its last result.
+const statsTTL = 30 * time.Second
+
+type galleryStats struct {
+	Images     int        `json:"images"`
+	TotalBytes int64      `json:"total_bytes"`
+	Albums     int        `json:"albums"`
+	Oldest     *time.Time `json:"oldest"`
+	Newest     *time.Time `json:"newest"`
+}
+
+var statsCache struct {
+	sync.Mutex
+	stats   galleryStats
+	expires time.Time
+}
+
+func apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := cachedStats()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
+
+// cachedStats returns the gallery totals, recomputing them at most once
+// per statsTTL.
+func cachedStats() (galleryStats, error) {
+	statsCache.Lock()
+	defer statsCache.Unlock()
+	if time.Now().Before(statsCache.expires) {
+		return statsCache.stats, nil
+	}
+	stats, err := computeStats()
+	if err != nil {
+		return galleryStats{}, err
+	}
+	statsCache.stats = stats
+	statsCache.expires = time.Now().Add(statsTTL)
+	return stats, nil
+}
+
+func computeStats() (galleryStats, error) {
+	var s galleryStats
+	var oldest, newest *int64
+	err := db.QueryRow(`SELECT COUNT(1), COALESCE(SUM(size_bytes), 0), MIN(created_at), MAX(created_at)
+		FROM images WHERE deleted_at IS NULL`).Scan(&s.Images, &s.TotalBytes, &oldest, &newest)
+	if err != nil {
+		return s, err
+	}
+	if err := db.QueryRow("SELECT COUNT(DISTINCT album) FROM (" + albumMembers + ")").Scan(&s.Albums); err != nil {
+		return s, err
+	}
+	if oldest != nil {
+		t := time.Unix(*oldest, 0)
+		s.Oldest = &t
+	}
+	if newest != nil {
+		t := time.Unix(*newest, 0)
+		s.Newest = &t
+	}
+	return s, nil
+}
+
+// apiFormatsHandler counts images and their bytes per file format.
+func apiFormatsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT COALESCE(format, ''), COUNT(1), COALESCE(SUM(size_bytes), 0)
+		FROM images WHERE deleted_at IS NULL GROUP BY COALESCE(format, '') ORDER BY 2 DESC, 1`)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	defer rows.Close()
+
+	type formatCount struct {
+		Format string `json:"format"`
+		Count  int    `json:"count"`
+		Bytes  int64  `json:"bytes"`
+	}
+	formats := []formatCount{}
+	for rows.Next() {
+		var f formatCount
+		if err := rows.Scan(&f.Format, &f.Count, &f.Bytes); err != nil {
+			continue
+		}
+		if f.Format == "" {
+			f.Format = "unknown"
+		}
+		formats = append(formats, f)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(formats)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// Storage abstracts where image files live, so originals and thumbnails
+// can move off the local disk (e.g. to S3) without touching handler logic.
+// Names are flat file names; Stat and Open report a missing file with an
+// error matching fs.ErrNotExist.
+type Storage interface {
+	Save(name string, r io.Reader) error
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	Delete(name string) error
+	// Rename moves a stored file to a new name, replacing any file there.
+	Rename(from, to string) error
+}
+
+// LocalStorage keeps files in a directory on the local filesystem.
+type LocalStorage struct {
+	Dir string
+}
+
+func (s LocalStorage) path(name string) string {
+	// never let a name escape the directory
+	return filepath.Join(s.Dir, filepath.Base(name))
+}
+
+// Save writes to a temp file in the same directory and renames it into
+// place, so concurrent readers see either no file or the whole file, never
+// a partial one.
+func (s LocalStorage) Save(name string, r io.Reader) error {
+	dst := s.path(name)
+	f, err := os.CreateTemp(s.Dir, ".tmp-"+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// CreateTemp makes the file private; stored files are public
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s LocalStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s LocalStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(s.path(name))
+}
+
+func (s LocalStorage) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s LocalStorage) Rename(from, to string) error {
+	return os.Rename(s.path(from), s.path(to))
+}
+
+// imageStore holds uploaded originals, thumbStore the generated thumbnails.
+var imageStore, thumbStore Storage
+
+func initStorage() {
+	imageStore = LocalStorage{Dir: imagesDir}
+	thumbStore = LocalStorage{Dir: thumbsDir}
+}
+
+// storeFileServer serves the files of a Storage under a stripped prefix,
+// like http.FileServer does for a directory but without listings.
+func storeFileServer(store Storage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		stat, err := store.Stat(name)
+		if err != nil || stat.IsDir() {
+			renderError(w, r, http.StatusNotFound, "file not found")
+			return
+		}
+		serveStored(w, r, store, name, stat)
+	})
+}
+
+// serveStored writes a stored file. Seekable files go through
+// http.ServeContent, so Range and conditional requests work.
+func serveStored(w http.ResponseWriter, r *http.Request, store Storage, name string, stat os.FileInfo) {
+	f, err := store.Open(name)
+	if err != nil {
+		renderError(w, r, http.StatusNotFound, "file not found")
+		return
+	}
+	defer f.Close()
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, stat.ModTime(), rs)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = io.Copy(w, f)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// parseTags splits a comma-separated form value into normalized tags.
+func parseTags(s string) []string {
+	return normalizeTags(strings.Split(s, ","))
+}
+
+// normalizeTags trims and lowercases tags, dropping blanks and repeats.
+func normalizeTags(in []string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, t := range in {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	return out
+}
+
+// setImageTags attaches tags to an image, creating unknown tags on the way.
+func setImageTags(imageID string, tags []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, t := range tags {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags(name) VALUES(?)", t); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO image_tags(image_id, tag_id) SELECT ?, id FROM tags WHERE name = ?", imageID, t); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// imageTags returns the sorted tag names of one image.
+func imageTags(imageID string) ([]string, error) {
+	rows, err := db.Query("SELECT t.name FROM image_tags it JOIN tags t ON t.id = it.tag_id WHERE it.image_id = ? ORDER BY t.name", imageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tags = append(tags, name)
+	}
+	return tags, rows.Err()
+}
+
+// attachTags fills in Tags for a page of images with a single query.
+func attachTags(images []ImageRow) error {
+	if len(images) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, len(images))
+	byID := map[string]int{}
+	for i := range images {
+		ids[i] = images[i].ID
+		byID[images[i].ID] = i
+		images[i].Tags = []string{}
+	}
+	rows, err := db.Query("SELECT it.image_id, t.name FROM image_tags it JOIN tags t ON t.id = it.tag_id WHERE it.image_id IN ("+placeholders(len(ids))+") ORDER BY t.name", ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		if i, ok := byID[id]; ok {
+			images[i].Tags = append(images[i].Tags, name)
+		}
+	}
+	return rows.Err()
+}
+
+// applyTagsHandler adds and removes tags on many images in one
+// transaction, from {"ids": [...], "add": [...], "remove": [...]}, and
+// returns the resulting tags of each image.
+func applyTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		IDs    []string `json:"ids"`
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if len(body.IDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "ids must not be empty")
+		return
+	}
+	add, remove := normalizeTags(body.Add), normalizeTags(body.Remove)
+	if len(add) == 0 && len(remove) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "nothing to add or remove")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	defer tx.Rollback()
+
+	for _, id := range body.IDs {
+		var exists bool
+		err := tx.QueryRow("SELECT 1 FROM images WHERE id = ? AND deleted_at IS NULL", id).Scan(&exists)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, http.StatusNotFound, "image "+id+" not found")
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+	for _, t := range add {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags(name) VALUES(?)", t); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+	for _, id := range body.IDs {
+		for _, t := range add {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO image_tags(image_id, tag_id) SELECT ?, id FROM tags WHERE name = ?", id, t); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "db error")
+				return
+			}
+		}
+		for _, t := range remove {
+			if _, err := tx.Exec("DELETE FROM image_tags WHERE image_id = ? AND tag_id IN (SELECT id FROM tags WHERE name = ?)", id, t); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "db error")
+				return
+			}
+		}
+		// listings' ETags go by updated_at
+		if _, err := tx.Exec("UPDATE images SET updated_at = ? WHERE id = ?", time.Now().Unix(), id); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("apply tags error:", err)
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	result := map[string][]string{}
+	for _, id := range body.IDs {
+		tags, err := imageTags(id)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		result[id] = tags
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"tags": result})
+}
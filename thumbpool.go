@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// thumbQueuePerWorker sizes the job queue relative to the worker count.
+const thumbQueuePerWorker = 8
+
+// errThumbBusy is returned when a thumbnail job could not be queued within
+// thumbWait because the pool is saturated.
+var errThumbBusy = errors.New("thumbnail queue is full")
+
+// thumbJob is one resize handed to the worker pool.
+type thumbJob struct {
+	fn   func() error
+	done chan error
+}
+
+var (
+	thumbJobs      chan thumbJob
+	thumbPoolStart sync.Once
+)
+
+// startThumbWorkers launches thumbWorkers goroutines draining a bounded
+// job queue, so a burst of cold thumbnail requests can't run an unbounded
+// number of decodes at once.
+func startThumbWorkers() {
+	thumbJobs = make(chan thumbJob, thumbWorkers*thumbQueuePerWorker)
+	for i := 0; i < thumbWorkers; i++ {
+		go func() {
+			for job := range thumbJobs {
+				job.done <- runThumbJob(job.fn)
+			}
+		}()
+	}
+}
+
+// runThumbJob runs fn on a worker, turning a panic into an error so one
+// bad image can't take a worker (or the process) down.
+func runThumbJob(fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("thumbnail worker panic: %v", p)
+			err = fmt.Errorf("thumbnail worker panic: %v", p)
+		}
+	}()
+	return fn()
+}
+
+// submitThumbJob queues fn for the pool and waits for its result. It gives
+// up with errThumbBusy when the queue stays full for thumbWait.
+func submitThumbJob(fn func() error) error {
+	thumbPoolStart.Do(startThumbWorkers)
+	job := thumbJob{fn: fn, done: make(chan error, 1)}
+	t := time.NewTimer(thumbWait)
+	defer t.Stop()
+	select {
+	case thumbJobs <- job:
+	case <-t.C:
+		return errThumbBusy
+	}
+	return <-job.done
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+	"github.com/gorilla/mux"
+	"golang.org/x/sync/singleflight"
+)
+
+// thumbSizes whitelists the sizes thumbHandler will generate; anything else
+// is rejected so clients can't fill thumbsDir with arbitrary variants.
+var thumbSizes = []string{
+	"150x150",
+	"300x300",
+	"400x300", // gallery grid
+	"800x600",
+	"1200x1200",
+}
+
+// storedFilename matches the names uploads are stored under: a UUID plus a
+// known image extension. thumbHandler rejects anything else before the name
+// reaches a path or a thumbnail name.
+var storedFilename = regexp.MustCompile(`^[0-9a-f-]{36}\.(jpg|jpeg|png|gif|webp)$`)
+
+// pregenThumbSizes are generated in the background right after an upload so
+// the first gallery visitor doesn't pay for the resize.
+var pregenThumbSizes = []string{"300x300", "800x600"}
+
+// Thumbnail modes: fit keeps the aspect ratio inside the box, fill
+// center-crops to exactly the requested size.
+const (
+	modeFit  = "fit"
+	modeFill = "fill"
+)
+
+// Thumbnail re-encoding targets; an empty format keeps the source image's
+// own format.
+const (
+	formatWebP = "webp"
+	formatPNG  = "png"
+	formatJPEG = "jpeg"
+)
+
+// thumbFormatExts maps the formats a thumbnail can be re-encoded to, as
+// accepted by ?format=, to the extension their cache files get.
+var thumbFormatExts = map[string]string{
+	formatWebP: ".webp",
+	formatPNG:  ".png",
+	formatJPEG: ".jpg",
+}
+
+// thumbSpec describes one cached variant of a source image. The zero
+// size is the full image, used for watermarked originals.
+type thumbSpec struct {
+	W, H   int
+	Mode   string
+	Format string
+}
+
+var thumbGroup singleflight.Group
+
+func thumbHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	size := vars["size"]
+	filename := vars["filename"]
+	if !storedFilename.MatchString(filename) {
+		renderError(w, r, http.StatusBadRequest, "invalid filename")
+		return
+	}
+
+	if !allowedThumbSize(size) {
+		renderError(w, r, http.StatusBadRequest, "size not allowed")
+		return
+	}
+	wid, hei, err := parseThumbSize(size)
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = modeFit
+	}
+	if mode != modeFit && mode != modeFill {
+		renderError(w, r, http.StatusBadRequest, "invalid mode")
+		return
+	}
+
+	spec := thumbSpec{W: wid, H: hei, Mode: mode}
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		if format == "jpg" {
+			format = formatJPEG
+		}
+		if _, ok := thumbFormatExts[format]; !ok {
+			renderError(w, r, http.StatusBadRequest, "format must be png, jpeg or webp")
+			return
+		}
+		spec.Format = format
+	} else if acceptsWebP(r) {
+		spec.Format = formatWebP
+	}
+	// the body depends on Accept, so shared caches must key on it
+	w.Header().Set("Vary", "Accept")
+
+	name := thumbName(spec, filename)
+	if _, err := thumbStore.Stat(name); err != nil && !thumbUpscale {
+		// thumbnails of smaller sources are cached under their real size
+		if sw, sh, err := sourceSize(filename); err == nil {
+			spec = capThumbSpec(spec, sw, sh)
+			name = thumbName(spec, filename)
+		}
+	}
+	if _, err := thumbStore.Stat(name); err == nil {
+		thumbRequestsTotal.WithLabelValues("hit").Inc()
+		touchThumb(name)
+		serveFileWithCache(w, r, thumbStore, name)
+		return
+	}
+
+	if !thumbOnDemand {
+		// WebP was only negotiated, so the source-format thumbnail the
+		// upload pre-generated will do
+		plain := thumbName(thumbSpec{W: spec.W, H: spec.H, Mode: mode}, filename)
+		if _, err := thumbStore.Stat(plain); err == nil && r.URL.Query().Get("format") == "" {
+			thumbRequestsTotal.WithLabelValues("hit").Inc()
+			touchThumb(plain)
+			serveFileWithCache(w, r, thumbStore, plain)
+			return
+		}
+		renderError(w, r, http.StatusNotFound, "thumbnail not found")
+		return
+	}
+
+	if _, err := imageStore.Stat(filename); err != nil {
+		renderError(w, r, http.StatusNotFound, "image not found")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), thumbWait)
+	defer cancel()
+	name, err = generateThumb(ctx, filename, spec)
+	if err != nil {
+		if errors.Is(err, errThumbBusy) || errors.Is(err, context.DeadlineExceeded) {
+			w.Header().Set("Retry-After", "5")
+			renderError(w, r, http.StatusServiceUnavailable, "thumbnail generation is busy, try again")
+			return
+		}
+		if errors.Is(err, context.Canceled) {
+			// the client went away
+			return
+		}
+		log.Println("thumb error:", err)
+		renderError(w, r, http.StatusInternalServerError, "thumbnail generation failed")
+		return
+	}
+	thumbRequestsTotal.WithLabelValues("generated").Inc()
+	touchThumb(name)
+
+	serveFileWithCache(w, r, thumbStore, name)
+}
+
+// generateThumb makes sure the thumbnail of filename described by spec
+// exists in thumbStore and returns its name. Concurrent calls for the same
+// thumbnail share a single resize, which runs on the thumbnail worker pool.
+// Giving up on ctx doesn't cancel the resize; it still fills the cache.
+// Unless thumbUpscale is set, spec is first capped to the source size.
+func generateThumb(ctx context.Context, filename string, spec thumbSpec) (string, error) {
+	if !thumbUpscale {
+		if sw, sh, err := sourceSize(filename); err == nil {
+			spec = capThumbSpec(spec, sw, sh)
+		}
+	}
+	name := thumbName(spec, filename)
+	ch := thumbGroup.DoChan(name, func() (interface{}, error) {
+		if _, err := thumbStore.Stat(name); err == nil {
+			return nil, nil
+		}
+		return nil, submitThumbJob(func() error { return resizeThumb(filename, name, spec) })
+	})
+	select {
+	case res := <-ch:
+		return name, res.Err
+	case <-ctx.Done():
+		return name, ctx.Err()
+	}
+}
+
+// resizeThumb decodes filename and stores its thumbnail under name.
+func resizeThumb(filename, name string, spec thumbSpec) error {
+	src, err := imageStore.Open(filename)
+	if err != nil {
+		return fmt.Errorf("open image: %w", err)
+	}
+	defer src.Close()
+	img, err := decodeImage(src)
+	if err != nil {
+		return fmt.Errorf("decode image: %w", err)
+	}
+	var thumb image.Image
+	switch {
+	case spec.W == 0:
+		thumb = img
+	case spec.Mode == modeFill:
+		thumb = imaging.Fill(img, spec.W, spec.H, imaging.Center, imaging.Lanczos)
+	default:
+		thumb = imaging.Fit(img, spec.W, spec.H, imaging.Lanczos)
+	}
+	if watermarkImg != nil {
+		thumb = applyWatermark(thumb)
+	}
+	var buf bytes.Buffer
+	if err := encodeThumb(&buf, thumb, name); err != nil {
+		return fmt.Errorf("encode thumb: %w", err)
+	}
+	if err := thumbStore.Save(name, &buf); err != nil {
+		return fmt.Errorf("save thumb: %w", err)
+	}
+	return nil
+}
+
+// pregenerateThumbs builds pregenThumbSizes for a fresh upload. It runs in
+// its own goroutine, so failures are only logged.
+func pregenerateThumbs(filename string) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("pregenerate thumbs %s: panic: %v", filename, p)
+		}
+	}()
+	for _, size := range pregenThumbSizes {
+		w, h, err := parseThumbSize(size)
+		if err != nil {
+			log.Printf("pregenerate thumbs %s: %v", filename, err)
+			continue
+		}
+		if _, err := generateThumb(context.Background(), filename, thumbSpec{W: w, H: h, Mode: modeFit}); err != nil {
+			log.Printf("pregenerate thumbs %s: %v", filename, err)
+		}
+	}
+	if watermarkOriginals && watermarkImg != nil {
+		if _, err := generateThumb(context.Background(), filename, thumbSpec{}); err != nil {
+			log.Printf("pregenerate thumbs %s: %v", filename, err)
+		}
+	}
+}
+
+// thumbName is the cache file name for a thumbnail. Fit thumbnails in the
+// source format keep the original "WxH_file" naming so existing caches stay
+// valid; other modes, formats and the watermark are encoded around it.
+func thumbName(spec thumbSpec, filename string) string {
+	mark := ""
+	if watermarkTag != "" {
+		mark = watermarkTag + "_"
+	}
+	name := fmt.Sprintf("%dx%d_%s%s", spec.W, spec.H, mark, filename)
+	switch {
+	case spec.W == 0:
+		name = "full_" + mark + filename
+	case spec.Mode == modeFill:
+		name = fmt.Sprintf("%dx%d_%sfill_%s", spec.W, spec.H, mark, filename)
+	}
+	if ext := thumbFormatExts[spec.Format]; ext != "" && !strings.EqualFold(filepath.Ext(filename), ext) {
+		name += ext
+	}
+	return name
+}
+
+// thumbSource recovers the original filename a cached thumbnail was built
+// from, checking candidates against known. It returns "" when none match.
+func thumbSource(thumb string, known map[string]bool) string {
+	i := strings.Index(thumb, "_")
+	if i < 0 {
+		return ""
+	}
+	rest := thumb[i+1:]
+	if strings.HasPrefix(rest, "wm-") {
+		if j := strings.Index(rest, "_"); j >= 0 {
+			rest = rest[j+1:]
+		}
+	}
+	for _, cand := range []string{rest, strings.TrimPrefix(rest, modeFill+"_")} {
+		if known[cand] {
+			return cand
+		}
+		// re-encoded thumbnails carry an extra format extension
+		if trimmed := strings.TrimSuffix(cand, filepath.Ext(cand)); known[trimmed] {
+			return trimmed
+		}
+	}
+	return ""
+}
+
+// sourceSize reads the dimensions of a stored original from its header.
+func sourceSize(filename string) (int, int, error) {
+	f, err := imageStore.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// capThumbSpec keeps a thumbnail of a w x h source from being enlarged.
+// A fit box the source already fits in shrinks to the source size; a fill
+// box larger than the source shrinks, keeping its aspect ratio, until it
+// fits inside it. The zero size (full image) is left alone.
+func capThumbSpec(spec thumbSpec, w, h int) thumbSpec {
+	if spec.W == 0 || w <= 0 || h <= 0 {
+		return spec
+	}
+	if spec.Mode == modeFill {
+		if w < spec.W || h < spec.H {
+			scale := min(float64(w)/float64(spec.W), float64(h)/float64(spec.H))
+			spec.W = max(1, int(float64(spec.W)*scale))
+			spec.H = max(1, int(float64(spec.H)*scale))
+		}
+		return spec
+	}
+	if w <= spec.W && h <= spec.H {
+		spec.W, spec.H = w, h
+	}
+	return spec
+}
+
+// thumbVariants lists every cache name thumbHandler can produce for
+// filename, so they can be removed without listing the store. While the
+// original exists this includes the names of size-capped thumbnails.
+func thumbVariants(filename string) []string {
+	names := thumbSizeVariants(filename, thumbSizes)
+	if watermarkTag != "" {
+		names = append(names, thumbName(thumbSpec{}, filename))
+	}
+	return names
+}
+
+// thumbSizeVariants is thumbVariants limited to the given sizes, without
+// the full-size watermarked copy.
+func thumbSizeVariants(filename string, sizes []string) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	sw, sh, sizeErr := sourceSize(filename)
+	for _, size := range sizes {
+		w, h, err := parseThumbSize(size)
+		if err != nil {
+			continue
+		}
+		for _, mode := range []string{modeFit, modeFill} {
+			for _, format := range []string{"", formatWebP, formatPNG, formatJPEG} {
+				// re-encoding to the source format reuses the plain name
+				spec := thumbSpec{W: w, H: h, Mode: mode, Format: format}
+				specs := []thumbSpec{spec}
+				if sizeErr == nil {
+					specs = append(specs, capThumbSpec(spec, sw, sh))
+				}
+				for _, s := range specs {
+					name := thumbName(s, filename)
+					if !seen[name] {
+						seen[name] = true
+						names = append(names, name)
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// encodeThumb encodes img in the format implied by the extension of name.
+// imaging has no WebP encoder, so that format is handled separately.
+func encodeThumb(w io.Writer, img image.Image, name string) error {
+	if strings.EqualFold(filepath.Ext(name), ".webp") {
+		return webp.Encode(w, img, &webp.Options{Quality: float32(thumbQuality)})
+	}
+	format, err := imaging.FormatFromFilename(name)
+	if err != nil {
+		return err
+	}
+	if o, ok := img.(interface{ Opaque() bool }); ok && format == imaging.JPEG && !o.Opaque() {
+		// JPEG has no alpha; put transparent sources on white, not black
+		bg := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), color.White)
+		img = imaging.Overlay(bg, img, image.Pt(0, 0), 1)
+	}
+	// JPEG thumbnails are always baseline: image/jpeg, which imaging wraps,
+	// has no progressive encoder. Serving WebP to clients that accept it
+	// is the faster path on slow connections.
+	return imaging.Encode(w, img, format, imaging.JPEGQuality(thumbQuality))
+}
+
+// acceptsWebP reports whether the client advertised WebP support.
+func acceptsWebP(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "image/webp")
+}
+
+// thumbnailRef describes one available thumbnail size of an image, for
+// building srcset attributes.
+type thumbnailRef struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// thumbnailRefs lists the whitelisted thumbnail sizes of filename.
+func thumbnailRefs(filename string) []thumbnailRef {
+	refs := make([]thumbnailRef, 0, len(thumbSizes))
+	for _, size := range thumbSizes {
+		w, h, err := parseThumbSize(size)
+		if err != nil {
+			continue
+		}
+		refs = append(refs, thumbnailRef{Width: w, Height: h, URL: "/thumb/" + size + "/" + url.PathEscape(filename)})
+	}
+	return refs
+}
+
+// parseThumbSize splits a "WxH" size into positive width and height.
+func parseThumbSize(size string) (int, int, error) {
+	parts := strings.Split(size, "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid size")
+	}
+	w, err1 := strconv.Atoi(parts[0])
+	h, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid size numbers")
+	}
+	return w, h, nil
+}
+
+func allowedThumbSize(size string) bool {
+	for _, s := range thumbSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestCapThumbSpec(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   thumbSpec
+		w, h   int
+		wantWH [2]int
+	}{
+		{"fit larger source", thumbSpec{W: 300, H: 300, Mode: modeFit}, 1200, 800, [2]int{300, 300}},
+		{"fit source inside box", thumbSpec{W: 800, H: 600, Mode: modeFit}, 640, 480, [2]int{640, 480}},
+		{"fit source exactly the box", thumbSpec{W: 800, H: 600, Mode: modeFit}, 800, 600, [2]int{800, 600}},
+		// only one side fits, so the fit box still downscales
+		{"fit wide source", thumbSpec{W: 300, H: 300, Mode: modeFit}, 400, 100, [2]int{300, 300}},
+		{"fill larger source", thumbSpec{W: 400, H: 300, Mode: modeFill}, 1200, 800, [2]int{400, 300}},
+		{"fill smaller source", thumbSpec{W: 400, H: 300, Mode: modeFill}, 200, 200, [2]int{200, 150}},
+		{"fill short source", thumbSpec{W: 400, H: 300, Mode: modeFill}, 1000, 150, [2]int{200, 150}},
+		{"fill tiny source", thumbSpec{W: 1200, H: 1200, Mode: modeFill}, 1, 3, [2]int{1, 1}},
+		{"full size untouched", thumbSpec{}, 100, 100, [2]int{0, 0}},
+		{"unknown source size", thumbSpec{W: 300, H: 300, Mode: modeFit}, 0, 0, [2]int{300, 300}},
+	}
+	for _, tt := range tests {
+		got := capThumbSpec(tt.spec, tt.w, tt.h)
+		if got.W != tt.wantWH[0] || got.H != tt.wantWH[1] {
+			t.Errorf("%s: capThumbSpec(%dx%d %s, %dx%d) = %dx%d, want %dx%d", tt.name,
+				tt.spec.W, tt.spec.H, tt.spec.Mode, tt.w, tt.h, got.W, got.H, tt.wantWH[0], tt.wantWH[1])
+		}
+		if got.Mode != tt.spec.Mode || got.Format != tt.spec.Format {
+			t.Errorf("%s: mode or format changed: %+v", tt.name, got)
+		}
+	}
+}
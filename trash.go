@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultPurgeDays is how long purge keeps trashed images when ?days is not
+// given.
+const defaultPurgeDays = 30
+
+// apiTrashHandler lists soft-deleted images, most recently deleted first.
+func apiTrashHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page := atoiDefault(q.Get("page"), 1)
+	per := clampPer(atoiDefault(q.Get("per"), defaultPer))
+	filter := imageFilter{Trashed: true}
+	where, args := filter.where()
+
+	rows, err := db.Query("SELECT "+imageColumns+" FROM images"+where+" ORDER BY deleted_at DESC, id DESC LIMIT ? OFFSET ?", append(args, per, (page-1)*per)...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db err")
+		return
+	}
+	defer rows.Close()
+	images := []ImageRow{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			continue
+		}
+		images = append(images, img)
+	}
+	rows.Close()
+	if err := attachTags(images); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db err")
+		return
+	}
+	writeImagesPage(w, r, page, per, countImages(filter), images)
+}
+
+// restoreImageHandler takes an image back out of the trash.
+func restoreImageHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ok, err := restoreImage(id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "not in trash")
+		return
+	}
+	img, err := getImage(id)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	img.Tags, _ = imageTags(img.ID)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(img)
+}
+
+// restoreImage clears deleted_at and reports whether the image was in the
+// trash.
+func restoreImage(id string) (bool, error) {
+	res, err := db.Exec("UPDATE images SET deleted_at = NULL, updated_at = ? WHERE id = ? AND deleted_at IS NOT NULL", time.Now().Unix(), id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// purgeTrashHandler permanently removes images that have been in the trash
+// for more than ?days days (default defaultPurgeDays), files included.
+func purgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	days := defaultPurgeDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid days")
+			return
+		}
+		days = n
+	}
+	cutoff := time.Now().AddDate(0, 0, -days).Unix()
+
+	rows, err := db.Query("SELECT id, filename FROM images WHERE deleted_at IS NOT NULL AND deleted_at <= ?", cutoff)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	victims := map[string]string{}
+	for rows.Next() {
+		var id, filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			continue
+		}
+		victims[id] = filename
+	}
+	rows.Close()
+
+	purged := 0
+	for id, filename := range victims {
+		if err := purgeImage(id, filename); err != nil {
+			log.Printf("purge %s: %v", id, err)
+			continue
+		}
+		purged++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
+
+// purgeImage deletes an image row with its tags, original and thumbnails.
+func purgeImage(id, filename string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM image_tags WHERE image_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM images WHERE id = ?", id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	removeImageFiles(filename)
+	return nil
+}
+
+// removeImageFiles deletes an original and its cached thumbnails.
+func removeImageFiles(filename string) {
+	// never trust the stored name to stay inside the data dirs
+	filename = filepath.Base(filename)
+	removeThumbs(filename)
+	if err := imageStore.Delete(filename); err != nil && !os.IsNotExist(err) {
+		log.Println("remove image error:", err)
+	}
+}
+
+// batchDeleteHandler deletes every image in {"ids": [...]} in one
+// transaction, moving them to the trash like DELETE /api/images/{id}, or
+// removing rows, files and thumbnails for good with ?permanent=true. The
+// response maps each id to "deleted" or "not found".
+func batchDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if len(body.IDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "ids must not be empty")
+		return
+	}
+	permanent, _ := strconv.ParseBool(r.URL.Query().Get("permanent"))
+
+	results, files, err := batchDelete(body.IDs, permanent)
+	if err != nil {
+		log.Println("batch delete error:", err)
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	// files only go once the rows are committed
+	for _, filename := range files {
+		removeImageFiles(filename)
+	}
+	for id, res := range results {
+		if res == "deleted" {
+			events.emit(galleryEvent{Type: "deleted", ID: id})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// batchDelete runs the row changes of batchDeleteHandler in a single
+// transaction and returns the per-id results plus the filenames whose
+// files should be removed after a permanent delete.
+func batchDelete(ids []string, permanent bool) (map[string]string, []string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	results, files, err := deleteImagesTx(tx, ids, permanent)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return results, files, nil
+}
+
+// deleteImagesTx trashes or, when permanent, removes the rows of ids
+// within tx. Files are left to the caller, who gets their names back.
+func deleteImagesTx(tx *sql.Tx, ids []string, permanent bool) (map[string]string, []string, error) {
+	results := map[string]string{}
+	var files []string
+	now := time.Now().Unix()
+	for _, id := range ids {
+		if !permanent {
+			res, err := tx.Exec("UPDATE images SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", now, id)
+			if err != nil {
+				return nil, nil, err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				results[id] = "not found"
+			} else {
+				results[id] = "deleted"
+			}
+			continue
+		}
+
+		var filename string
+		err := tx.QueryRow("SELECT filename FROM images WHERE id = ?", id).Scan(&filename)
+		if err == sql.ErrNoRows {
+			results[id] = "not found"
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM image_tags WHERE image_id = ?", id); err != nil {
+			return nil, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM images WHERE id = ?", id); err != nil {
+			return nil, nil, err
+		}
+		results[id] = "deleted"
+		files = append(files, filename)
+	}
+	return results, files, nil
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// uploadMeta holds the form values shared by every file of one upload.
+type uploadMeta struct {
+	Title       string
+	Description string
+	Album       string
+	Tags        []string
+}
+
+// uploadFailure carries the HTTP status an individual file was rejected with.
+type uploadFailure struct {
+	Status int
+	Msg    string
+}
+
+func (e *uploadFailure) Error() string { return e.Msg }
+
+// errUploadTooLarge aborts an upload whose request body passed its
+// limit. Handlers report it with uploadTooLarge, which names the limit.
+var errUploadTooLarge = &uploadFailure{http.StatusRequestEntityTooLarge, "upload too large"}
+
+// uploadTooLarge is errUploadTooLarge with the limit that applied.
+func uploadTooLarge(limit int64) *uploadFailure {
+	if limit >= 1<<20 {
+		return &uploadFailure{http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds the %d MB limit", limit>>20)}
+	}
+	return &uploadFailure{http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds the %d byte limit", limit)}
+}
+
+// maxFieldSize caps the text fields of the upload form.
+const maxFieldSize = 64 << 10
+
+// uploadHandler streams the multipart body part by part, so memory use
+// stays flat whatever the file sizes. Files are staged on disk as they
+// arrive; the text fields may follow them in the stream, so rows are only
+// written once the whole form has been read. With ?validate=true nothing
+// is stored; the response lists what would happen to each file.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	validateOnly, _ := strconv.ParseBool(r.URL.Query().Get("validate"))
+	limit := uploadLimit(r)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		uploadError(w, r, http.StatusBadRequest, "invalid form")
+		return
+	}
+
+	var meta uploadMeta
+	var staged []*stagedUpload
+	defer func() {
+		for _, st := range staged {
+			os.Remove(st.Path)
+		}
+	}()
+	var failures []error
+	var verdicts []uploadVerdict
+	files := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				uploadError(w, r, http.StatusRequestEntityTooLarge, uploadTooLarge(limit).Msg)
+			} else {
+				uploadError(w, r, http.StatusBadRequest, "invalid form")
+			}
+			return
+		}
+		switch part.FormName() {
+		// "images" carries multi-file uploads; "image" is the original
+		// single-file field and keeps working.
+		case "images", "image":
+			if part.FileName() == "" {
+				// an empty file input
+				part.Close()
+				continue
+			}
+			files++
+			st, err := stageUpload(part)
+			part.Close()
+			if err == errUploadTooLarge {
+				uploadError(w, r, http.StatusRequestEntityTooLarge, uploadTooLarge(limit).Msg)
+				return
+			}
+			if err != nil && validateOnly {
+				verdicts = append(verdicts, uploadVerdict{Name: part.FileName(), Status: failureStatus(err), Error: err.Error()})
+				continue
+			}
+			if err != nil {
+				log.Printf("upload %q: %v", part.FileName(), err)
+				uploadsTotal.WithLabelValues("failed").Inc()
+				failures = append(failures, err)
+				continue
+			}
+			st.Name = part.FileName()
+			staged = append(staged, st)
+		case "title":
+			meta.Title = readField(part)
+		case "description":
+			meta.Description = readField(part)
+		case "album":
+			meta.Album = normalizeAlbum(readField(part))
+		case "tags":
+			meta.Tags = parseTags(readField(part))
+		default:
+			part.Close()
+		}
+	}
+	if files == 0 {
+		uploadError(w, r, http.StatusBadRequest, "image required")
+		return
+	}
+	if utf8.RuneCountInString(meta.Description) > maxDescription {
+		uploadError(w, r, http.StatusBadRequest, fmt.Sprintf("description exceeds %d characters", maxDescription))
+		return
+	}
+	if validateOnly {
+		writeVerdicts(w, append(verdicts, validateStaged(staged)...))
+		return
+	}
+
+	created := []ImageRow{}
+	duplicates := 0
+	for _, st := range staged {
+		img, dup, err := saveUpload(st, meta)
+		if err != nil {
+			log.Printf("upload %q: %v", st.Name, err)
+			uploadsTotal.WithLabelValues("failed").Inc()
+			failures = append(failures, err)
+			continue
+		}
+		if dup {
+			uploadsTotal.WithLabelValues("duplicate").Inc()
+			duplicates++
+		} else {
+			uploadsTotal.WithLabelValues("created").Inc()
+			go processUpload(img.ID, img.Filename)
+			ev := img
+			events.emit(galleryEvent{Type: "uploaded", ID: img.ID, Image: &ev})
+		}
+		created = append(created, img)
+	}
+
+	if wantsJSON(r) {
+		status := http.StatusOK
+		if len(created) == 0 {
+			status = failureStatus(failures[0])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"succeeded":  len(created),
+			"duplicates": duplicates,
+			"failed":     len(failures),
+			"images":     created,
+		})
+		return
+	}
+
+	switch {
+	case len(failures) == 0:
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	case len(created) == 0:
+		http.Error(w, failures[0].Error(), failureStatus(failures[0]))
+	default:
+		fmt.Fprintf(w, "uploaded %d, failed %d\n", len(created), len(failures))
+	}
+}
+
+// uploadVerdict is what a ?validate=true upload reports for one file.
+type uploadVerdict struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	Status     int    `json:"status"` // what the real upload would answer
+	Error      string `json:"error,omitempty"`
+	Duplicate  bool   `json:"duplicate,omitempty"`
+	ExistingID string `json:"existing_id,omitempty"`
+	Format     string `json:"format,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+}
+
+// validateStaged checks staged files against the existing images and the
+// storage quota without storing anything. Quota is reserved across the
+// batch, so the verdicts reflect uploading all accepted files together.
+func validateStaged(staged []*stagedUpload) []uploadVerdict {
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	verdicts := make([]uploadVerdict, 0, len(staged))
+	for _, st := range staged {
+		v := uploadVerdict{Name: st.Name, OK: true, Status: http.StatusOK, Format: st.Format, Width: st.Width, Height: st.Height}
+		if existing, err := findByChecksum(st.Checksum); err == nil {
+			v.Duplicate, v.ExistingID = true, existing.ID
+		} else if release, err := reserveBytes(st.Size); err != nil {
+			v.OK, v.Status, v.Error = false, failureStatus(err), err.Error()
+			if err != errQuotaExceeded {
+				v.Status, v.Error = http.StatusInternalServerError, "db error"
+			}
+		} else {
+			releases = append(releases, release)
+		}
+		verdicts = append(verdicts, v)
+	}
+	return verdicts
+}
+
+// writeVerdicts answers a ?validate=true upload.
+func writeVerdicts(w http.ResponseWriter, verdicts []uploadVerdict) {
+	valid := 0
+	for _, v := range verdicts {
+		if v.OK {
+			valid++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"valid":   valid,
+		"invalid": len(verdicts) - valid,
+		"files":   verdicts,
+	})
+}
+
+// stagedUpload is an uploaded image that passed validation and sits in a
+// local temp file, ready to be processed and handed to the store.
+type stagedUpload struct {
+	Name      string // file name sent by the client
+	Path      string // temp file; the caller removes it
+	Ext       string
+	Format    string // jpeg, png, gif or webp, from the sniffed content type
+	Checksum  string // of the bytes as uploaded
+	Size      int64
+	Width     int
+	Height    int
+	TakenAt   time.Time // zero when the EXIF capture date is missing
+	Lat, Lng  *float64  // EXIF GPS position, nil when missing
+	Stored    string    // already in imageStore; saveUpload only inserts its row
+	oversized bool
+}
+
+// stageUpload copies an uploaded file to a temp file, hashing it on the
+// way, and validates it. Rejections are reported as *uploadFailure.
+func stageUpload(r io.Reader) (*stagedUpload, error) {
+	out, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, &uploadFailure{http.StatusInternalServerError, "unable to save file"}
+	}
+	st := &stagedUpload{Path: out.Name()}
+	// hash while copying so the content is only read once
+	hasher := sha256.New()
+	st.Size, err = io.Copy(io.MultiWriter(out, hasher), r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(st.Path)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, errUploadTooLarge
+		}
+		return nil, &uploadFailure{http.StatusInternalServerError, "save error"}
+	}
+	st.Checksum = hex.EncodeToString(hasher.Sum(nil))
+
+	if err := st.validate(); err != nil {
+		os.Remove(st.Path)
+		return nil, err
+	}
+	return st, nil
+}
+
+// validate sniffs the staged file's type and checks its dimensions, then
+// gives it the matching extension, which tells imaging which encoder to use.
+func (st *stagedUpload) validate() error {
+	f, err := os.Open(st.Path)
+	if err != nil {
+		return &uploadFailure{http.StatusInternalServerError, "unable to read file"}
+	}
+	defer f.Close()
+
+	// sniff the content instead of trusting the client's extension
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return &uploadFailure{http.StatusBadRequest, "unable to read file"}
+	}
+	ctype := http.DetectContentType(head[:n])
+	ext, ok := imageTypes[ctype]
+	if !ok {
+		return &uploadFailure{http.StatusUnsupportedMediaType, "unsupported image type"}
+	}
+	st.Format = formatOf(ctype)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return &uploadFailure{http.StatusInternalServerError, "unable to read file"}
+	}
+
+	// only the header is decoded, so a huge panorama is never fully
+	// decoded just to be rejected
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return &uploadFailure{http.StatusUnsupportedMediaType, "unreadable image"}
+	}
+	st.Width, st.Height = cfg.Width, cfg.Height
+	st.oversized = maxDimension > 0 && (cfg.Width > maxDimension || cfg.Height > maxDimension)
+	// downscaling a GIF would keep only its first frame, so those are
+	// always rejected
+	if st.oversized && (oversizePolicy != oversizeDownscale || st.Format == "gif") {
+		return &uploadFailure{http.StatusRequestEntityTooLarge, fmt.Sprintf("image exceeds %dpx", maxDimension)}
+	}
+	f.Close()
+
+	if err := os.Rename(st.Path, st.Path+ext); err != nil {
+		return &uploadFailure{http.StatusInternalServerError, "unable to save file"}
+	}
+	st.Path += ext
+	st.Ext = ext
+	return nil
+}
+
+// readExif records the capture time and position of the staged file.
+func (st *stagedUpload) readExif() {
+	if t, ok := exifTakenAt(st.Path); ok {
+		st.TakenAt = t
+	}
+	// with stripExif the position is private too, so it is not recorded
+	if lat, lng, ok := exifGPS(st.Path); ok && !stripExif {
+		st.Lat, st.Lng = &lat, &lng
+	}
+}
+
+// process applies the configured transformations to the staged file and
+// records its final size and dimensions.
+func (st *stagedUpload) process() error {
+	// read before stripping, which drops the EXIF block
+	st.readExif()
+	// phones store portrait shots rotated with an EXIF tag; fix the pixels
+	if err := autoOrient(st.Path); err != nil {
+		log.Println("auto orient error:", err)
+	}
+	// must come after autoOrient: the orientation lives in the EXIF we drop
+	if stripExif {
+		if err := stripMetadata(st.Path); err != nil {
+			log.Println("strip metadata error:", err)
+		}
+	}
+	if st.oversized {
+		if err := downscale(st.Path, maxDimension); err != nil {
+			log.Println("downscale error:", err)
+			return &uploadFailure{http.StatusInternalServerError, "unable to downscale image"}
+		}
+	}
+
+	// orienting, stripping or downscaling may have rewritten the file
+	if fi, err := os.Stat(st.Path); err == nil {
+		st.Size = fi.Size()
+	}
+
+	// only the header is decoded, so this stays cheap for large images
+	var err error
+	st.Width, st.Height, err = imageDimensions(st.Path)
+	if err != nil {
+		log.Println("decode config error:", err)
+	}
+	return nil
+}
+
+// saveUpload stores one staged file in imageStore and inserts its row, or
+// only inserts the row when st.Stored is set.
+// When identical content was uploaded before, the new copy is discarded and
+// the existing row is returned with dup set. Rejections are reported as
+// *uploadFailure. The caller runs processUpload for new rows.
+func saveUpload(st *stagedUpload, meta uploadMeta) (img ImageRow, dup bool, err error) {
+	if existing, err := findByChecksum(st.Checksum); err == nil {
+		// uploading a trashed image again brings it back
+		if existing.DeletedAt != nil {
+			if _, err := restoreImage(existing.ID); err != nil {
+				log.Println("restore error:", err)
+			} else {
+				existing.DeletedAt = nil
+			}
+		}
+		return existing, true, nil
+	}
+
+	if st.Stored == "" {
+		if err := st.process(); err != nil {
+			return ImageRow{}, false, err
+		}
+	} else {
+		st.readExif()
+		if st.Width, st.Height, err = imageDimensions(st.Path); err != nil {
+			log.Println("decode config error:", err)
+		}
+	}
+	if meta.Album == "" {
+		meta.Album = defaultAlbum
+	}
+
+	release, err := reserveBytes(st.Size)
+	if err == errQuotaExceeded {
+		return ImageRow{}, false, err
+	}
+	if err != nil {
+		return ImageRow{}, false, &uploadFailure{http.StatusInternalServerError, "db error"}
+	}
+	defer release()
+
+	id := uuid.New().String()
+	filename := id + st.Ext
+	if st.Stored != "" {
+		filename = st.Stored
+	} else if err := storeFile(imageStore, filename, st.Path); err != nil {
+		log.Println("store image error:", err)
+		return ImageRow{}, false, &uploadFailure{http.StatusInternalServerError, "unable to save file"}
+	}
+
+	now := time.Unix(time.Now().Unix(), 0)
+	img = ImageRow{
+		ID:           id,
+		Filename:     filename,
+		OriginalName: sanitizeFilename(st.Name),
+		Title:        meta.Title,
+		Slug:         newSlug(meta.Title),
+		Description:  meta.Description,
+		Album:        meta.Album,
+		CreatedAt:    now,
+		Width:        st.Width,
+		Height:       st.Height,
+		UpdatedAt:    now,
+		Checksum:     st.Checksum,
+		SizeBytes:    st.Size,
+		TakenAt:      now,
+		Format:       st.Format,
+		Lat:          st.Lat,
+		Lng:          st.Lng,
+		Albums:       []string{},
+	}
+	if meta.Album != "" {
+		img.Albums = []string{meta.Album}
+	}
+	var takenAt interface{}
+	if !st.TakenAt.IsZero() {
+		img.TakenAt = st.TakenAt
+		takenAt = st.TakenAt.Unix()
+	}
+	// new images go to the end of their album's manual order: the
+	// membership trigger appends them, and images.position orders the
+	// uncategorized album
+	_, err = db.Exec(`INSERT INTO images(id, filename, original_name, title, slug, description, album, created_at, width, height, updated_at, checksum, size_bytes, taken_at, format, lat, lng, position)
+		VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?, (SELECT COALESCE(MAX(position), 0) + 1 FROM images WHERE album = ?))`,
+		img.ID, img.Filename, img.OriginalName, img.Title, img.Slug, img.Description, img.Album, now.Unix(), img.Width, img.Height, now.Unix(), img.Checksum, img.SizeBytes, takenAt, img.Format, img.Lat, img.Lng, img.Album)
+	if err != nil {
+		if st.Stored == "" {
+			imageStore.Delete(filename)
+		}
+		// a concurrent upload of the same content won the unique index
+		if existing, ferr := findByChecksum(st.Checksum); ferr == nil {
+			return existing, true, nil
+		}
+		log.Println("db insert error:", err)
+		return ImageRow{}, false, &uploadFailure{http.StatusInternalServerError, "db error"}
+	}
+
+	if err := db.QueryRow("SELECT "+primaryPosition+" FROM images WHERE id = ?", id).Scan(&img.Position); err != nil {
+		log.Println("db query error:", err)
+	}
+
+	if len(meta.Tags) > 0 {
+		if err := setImageTags(id, meta.Tags); err != nil {
+			log.Println("tag insert error:", err)
+		} else {
+			img.Tags = meta.Tags
+		}
+	}
+
+	return img, false, nil
+}
+
+// processUpload does the slow per-image work after the upload response has
+// been sent: pre-generating thumbnails and computing the placeholders.
+func processUpload(id, filename string) {
+	pregenerateThumbs(filename)
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("placeholders %s: panic: %v", filename, p)
+		}
+	}()
+	if err := updatePlaceholders(id, filename); err != nil {
+		log.Printf("placeholders %s: %v", filename, err)
+	}
+}
+
+// readField reads a text part of the upload form.
+func readField(part *multipart.Part) string {
+	defer part.Close()
+	b, _ := io.ReadAll(io.LimitReader(part, maxFieldSize))
+	return string(b)
+}
+
+// storeFile copies the local file at path into store under name.
+func storeFile(store Storage, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return store.Save(name, f)
+}
+
+func failureStatus(err error) int {
+	if f, ok := err.(*uploadFailure); ok {
+		return f.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadError reports an upload failure as JSON to scripts and as plain
+// text to form posts.
+func uploadError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if wantsJSON(r) {
+		writeJSONError(w, status, msg)
+		return
+	}
+	http.Error(w, msg, status)
+}
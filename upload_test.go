@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/chai2010/webp"
+)
+
+func TestDownscaleOversized(t *testing.T) {
+	defer func(max int, policy string) { maxDimension, oversizePolicy = max, policy }(maxDimension, oversizePolicy)
+	maxDimension, oversizePolicy = 16, oversizeDownscale
+
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, src, &webp.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := stageUpload(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("stage webp: %v", err)
+	}
+	defer os.Remove(st.Path)
+	if err := st.process(); err != nil {
+		t.Fatalf("process webp: %v", err)
+	}
+	if st.Width != 16 || st.Height != 8 {
+		t.Errorf("downscaled to %dx%d, want 16x8", st.Width, st.Height)
+	}
+	f, err := os.Open(st.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, format, err := image.DecodeConfig(f); err != nil || format != "webp" {
+		t.Errorf("stored as %q, %v; want webp", format, err)
+	}
+
+	// an animation would lose every frame but the first
+	pal := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{
+		Image: []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 64, 32), pal), image.NewPaletted(image.Rect(0, 0, 64, 32), pal)},
+		Delay: []int{10, 10},
+	}
+	buf.Reset()
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := stageUpload(bytes.NewReader(buf.Bytes())); err == nil {
+		os.Remove(st.Path)
+		t.Error("oversized gif was accepted")
+	} else if failureStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized gif: %v, want 413", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// viewFlushInterval is how often recorded views are written to the
+// database. Views are batched so a beacon never waits on a write.
+const viewFlushInterval = 2 * time.Second
+
+// views carries image ids from viewHandler to recordViews.
+var views = make(chan string, 1024)
+
+// viewsStop asks recordViews for a last flush; it closes the channel it
+// receives once that is written.
+var viewsStop = make(chan chan struct{})
+
+// recordViews batches incoming views and writes the counts and last view
+// times in one transaction per flush, until stopRecordingViews is called.
+func recordViews() {
+	t := time.NewTicker(viewFlushInterval)
+	defer t.Stop()
+	pending := map[string]int{}
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := flushViews(pending, time.Now()); err != nil {
+			log.Println("record views error:", err)
+		}
+		pending = map[string]int{}
+	}
+	for {
+		select {
+		case id := <-views:
+			pending[id]++
+		case <-t.C:
+			flush()
+		case done := <-viewsStop:
+			// take what is still queued too
+			for queued := true; queued; {
+				select {
+				case id := <-views:
+					pending[id]++
+				default:
+					queued = false
+				}
+			}
+			flush()
+			close(done)
+			return
+		}
+	}
+}
+
+// stopRecordingViews writes the views recordViews still holds and stops
+// it. The server calls it on shutdown, once no more beacons come in.
+func stopRecordingViews() {
+	done := make(chan struct{})
+	viewsStop <- done
+	<-done
+}
+
+func flushViews(pending map[string]int, at time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, n := range pending {
+		if _, err := tx.Exec("UPDATE images SET view_count = view_count + ?, last_viewed_at = ? WHERE id = ?", n, at.Unix(), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// viewHandler is a beacon the gallery calls when an image is opened. It
+// only queues the view, dropping it when the queue is full.
+func viewHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if img, err := getImage(id); err != nil || img.DeletedAt != nil {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	select {
+	case views <- id:
+	default:
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiRecentHandler lists the most recently viewed images.
+func apiRecentHandler(w http.ResponseWriter, r *http.Request) {
+	n := clampPer(atoiDefault(r.URL.Query().Get("n"), defaultPer))
+	rows, err := db.Query("SELECT "+imageColumns+" FROM images WHERE deleted_at IS NULL AND last_viewed_at IS NOT NULL ORDER BY last_viewed_at DESC, id DESC LIMIT ?", n)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	defer rows.Close()
+	images := []ImageRow{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			continue
+		}
+		images = append(images, img)
+	}
+	rows.Close()
+	if err := attachTags(images); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(images)
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestStopRecordingViewsFlushes(t *testing.T) {
+	openTestDB(t)
+	insertTestImage(t, "a", "trip")
+	go recordViews()
+	for i := 0; i < 3; i++ {
+		views <- "a"
+	}
+	stopRecordingViews()
+
+	var count int
+	if err := db.QueryRow("SELECT view_count FROM images WHERE id = 'a'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("view_count = %d after shutdown, want 3", count)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/disintegration/imaging"
+)
+
+// Corners a watermark can be placed in.
+var watermarkPositions = map[string]bool{
+	"top-left":     true,
+	"top-right":    true,
+	"bottom-left":  true,
+	"bottom-right": true,
+	"center":       true,
+}
+
+var (
+	// watermarkImg is the decoded logo; nil when watermarking is off.
+	watermarkImg image.Image
+	// watermarkTag identifies the logo, position and opacity in cache
+	// names, so changing any of them never serves stale thumbnails.
+	watermarkTag string
+)
+
+// loadWatermark decodes the logo named by watermarkPath once at startup.
+func loadWatermark() {
+	if watermarkPath == "" {
+		return
+	}
+	data, err := os.ReadFile(watermarkPath)
+	if err != nil {
+		log.Fatalf("watermark: %v", err)
+	}
+	img, err := imaging.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Fatalf("watermark %s: %v", watermarkPath, err)
+	}
+	h := sha256.New()
+	h.Write(data)
+	fmt.Fprintf(h, "|%s|%d", watermarkPosition, watermarkOpacity)
+	watermarkImg = img
+	watermarkTag = "wm-" + hex.EncodeToString(h.Sum(nil)[:4])
+}
+
+// applyWatermark overlays the logo on img. The logo is shrunk to a quarter
+// of the image width at most and kept a small margin off the edges.
+func applyWatermark(img image.Image) image.Image {
+	b := img.Bounds()
+	logo := watermarkImg
+	if maxW := b.Dx() / 4; logo.Bounds().Dx() > maxW && maxW > 0 {
+		logo = imaging.Resize(logo, maxW, 0, imaging.Lanczos)
+	}
+	lw, lh := logo.Bounds().Dx(), logo.Bounds().Dy()
+	margin := min(b.Dx(), b.Dy()) / 40
+
+	var x, y int
+	switch watermarkPosition {
+	case "top-left":
+		x, y = margin, margin
+	case "top-right":
+		x, y = b.Dx()-lw-margin, margin
+	case "bottom-left":
+		x, y = margin, b.Dy()-lh-margin
+	case "center":
+		x, y = (b.Dx()-lw)/2, (b.Dy()-lh)/2
+	default:
+		x, y = b.Dx()-lw-margin, b.Dy()-lh-margin
+	}
+	return imaging.Overlay(img, logo, image.Pt(b.Min.X+x, b.Min.Y+y), float64(watermarkOpacity)/100)
+}
+
+// servedOriginal returns the store and name the original of filename is
+// handed out from. With watermarkOriginals set that is a watermarked copy,
+// built on first use and kept in thumbStore even with -thumb-ondemand off;
+// otherwise it is the stored file itself.
+func servedOriginal(ctx context.Context, filename string) (Storage, string, error) {
+	if !watermarkOriginals || watermarkImg == nil {
+		return imageStore, filename, nil
+	}
+	name, err := generateThumb(ctx, filename, thumbSpec{})
+	if err != nil {
+		return nil, "", err
+	}
+	touchThumb(name)
+	return thumbStore, name, nil
+}
+
+// originalsHandler serves /images/, watermarked as servedOriginal decides.
+// /download/ and album ZIPs go through servedOriginal too.
+func originalsHandler() http.Handler {
+	plain := storeFileServer(imageStore)
+	if !watermarkOriginals || watermarkImg == nil {
+		return plain
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filename := path.Base(r.URL.Path)
+		if !storedFilename.MatchString(filename) {
+			renderError(w, r, http.StatusNotFound, "file not found")
+			return
+		}
+		if _, err := imageStore.Stat(filename); err != nil {
+			renderError(w, r, http.StatusNotFound, "file not found")
+			return
+		}
+		store, name, err := servedOriginal(r.Context(), filename)
+		if err != nil {
+			log.Println("watermark error:", err)
+			renderError(w, r, http.StatusInternalServerError, "image processing failed")
+			return
+		}
+		serveFileWithCache(w, r, store, name)
+	})
+}
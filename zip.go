@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// albumZipHandler streams every original in an album as a ZIP archive. The
+// archive is written straight to the response, so memory use does not grow
+// with the album.
+func albumZipHandler(w http.ResponseWriter, r *http.Request) {
+	album := mux.Vars(r)["album"]
+	key := albumKey(album)
+	rows, err := db.Query("SELECT "+imageColumns+" FROM images WHERE deleted_at IS NULL AND "+albumCond(key)+" ORDER BY created_at ASC, id ASC", key)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	images := []ImageRow{}
+	for rows.Next() {
+		img, err := scanImage(rows)
+		if err != nil {
+			continue
+		}
+		images = append(images, img)
+	}
+	rows.Close()
+	if len(images) == 0 {
+		writeJSONError(w, http.StatusNotFound, "album not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": album + ".zip"}))
+	zw := zip.NewWriter(w)
+	used := map[string]int{}
+	for _, img := range images {
+		if err := addToZip(r.Context(), zw, img, uniqueName(used, friendlyName(img))); err != nil {
+			// headers are already sent; all we can do is cut the archive short
+			log.Printf("album zip %s: %v", img.Filename, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("album zip %s: %v", album, err)
+	}
+}
+
+func addToZip(ctx context.Context, zw *zip.Writer, img ImageRow, name string) error {
+	store, stored, err := servedOriginal(ctx, filepath.Base(img.Filename))
+	if err != nil {
+		return err
+	}
+	f, err := store.Open(stored)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// photos are already compressed, so store them as-is
+	hdr := &zip.FileHeader{Name: name, Method: zip.Store, Modified: img.CreatedAt}
+	dst, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// uniqueName appends " (2)", " (3)", ... when several images share a title.
+func uniqueName(used map[string]int, name string) string {
+	key := strings.ToLower(name)
+	used[key]++
+	if used[key] == 1 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	candidate := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), used[key], ext)
+	return uniqueName(used, candidate)
+}